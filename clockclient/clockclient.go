@@ -0,0 +1,63 @@
+// Package clockclient holds the pieces shared by the programs that read the clock server's stream
+// (cmd/clockload, cmd/clockskew and cmd/clockwall): reading the time back from a tick line, the percentiles
+// they report, and shorter network errors.
+package clockclient
+
+import (
+	"errors"
+	"math"
+	"net"
+	"time"
+)
+
+// ParseTick reads the time in a tick line. RFC 3339 lines carry everything; "15:04:05" lines only the time of day,
+// so the date is the one (in loc) closest to when the line arrived, which also works across midnight.
+func ParseTick(line string, arrived time.Time, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, line); err == nil {
+		return t, nil
+	}
+	clock, err := time.ParseInLocation("15:04:05", line, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	today := arrived.In(loc)
+	best := time.Time{}
+	for _, day := range []int{-1, 0, 1} {
+		candidate := time.Date(today.Year(), today.Month(), today.Day()+day, clock.Hour(), clock.Minute(), clock.Second(), 0, loc)
+		if best.IsZero() || AbsDuration(candidate.Sub(arrived)) < AbsDuration(best.Sub(arrived)) {
+			best = candidate
+		}
+	}
+	return best, nil
+}
+
+// Percentile uses the nearest-rank method on an already sorted, non-empty slice.
+// https://en.wikipedia.org/wiki/Percentile#The_nearest-rank_method
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// AbsDuration is d without its sign: how far apart two times are, whichever came first.
+func AbsDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Round keeps durations readable in reports, microseconds are as precise as a loopback measurement gets.
+func Round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+// ShortError drops the "dial tcp 127.0.0.1:8000:" prefix. The callers already know the address, and without it
+// the same failure from many connections groups together.
+func ShortError(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,57 @@
+package clockclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTick(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, day, hour, min, sec int) time.Time {
+		return time.Date(2026, time.October, day, hour, min, sec, 0, loc)
+	}
+
+	tests := []struct {
+		name    string
+		line    string
+		arrived time.Time
+		loc     *time.Location
+		want    time.Time
+	}{
+		{name: "same day", line: "12:30:45", arrived: at(time.UTC, 18, 12, 30, 45), loc: time.UTC, want: at(time.UTC, 18, 12, 30, 45)},
+		{name: "sent before midnight, read after", line: "23:59:59", arrived: at(time.UTC, 19, 0, 0, 1), loc: time.UTC, want: at(time.UTC, 18, 23, 59, 59)},
+		{name: "server clock ahead across midnight", line: "00:00:01", arrived: at(time.UTC, 18, 23, 59, 58), loc: time.UTC, want: at(time.UTC, 19, 0, 0, 1)},
+		{name: "other zone", line: "21:30:45", arrived: at(time.UTC, 18, 12, 30, 45), loc: tokyo, want: at(tokyo, 18, 21, 30, 45)},
+		{name: "RFC 3339 carries its own date", line: "2026-10-18T12:30:45.5Z", arrived: at(time.UTC, 1, 0, 0, 0), loc: tokyo, want: at(time.UTC, 18, 12, 30, 45).Add(500 * time.Millisecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTick(tt.line, tt.arrived, tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseTick(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseTick("not a time", time.Now(), time.UTC); err == nil {
+		t.Error("ParseTick accepted a line without a time")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{{0, 1}, {10, 1}, {50, 5}, {51, 6}, {90, 9}, {99, 10}, {100, 10}} {
+		if got := Percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("Percentile(p%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// The broadcaster goroutine owns every client and room, just like in Chapter 8 of "The Go Programming Language":
+// handlers never touch that state, they send what happened through these channels and the broadcaster
+// answers by putting lines on the clients' outgoing channels.
+// https://go.dev/blog/codelab-share
+type broadcaster struct {
+	entering chan entry
+	leaving  chan departure
+	messages chan message
+	commands chan command
+	done     chan struct{} // Closed when run returns, so nobody blocks on the channels above afterwards
+}
+
+// entry asks for a nickname; the answer says whether it was free (and the client is now in).
+type entry struct {
+	c      *client
+	result chan bool
+}
+
+type departure struct {
+	c      *client
+	reason string // Shown to the others in the room
+}
+
+// message is a line said to the room the sender is in.
+type message struct {
+	from *client
+	text string
+}
+
+// command is one of /join, /who, /msg and /help, already split into name and argument.
+type command struct {
+	from *client
+	name string
+	arg  string
+}
+
+const defaultRoom = "lobby"
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		entering: make(chan entry),
+		leaving:  make(chan departure),
+		messages: make(chan message),
+		commands: make(chan command),
+		done:     make(chan struct{}),
+	}
+}
+
+// run is the broadcaster goroutine, it stops when ctx is cancelled.
+func (b *broadcaster) run(ctx context.Context) {
+	defer close(b.done)
+
+	clients := make(map[string]*client) // By nickname
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case e := <-b.entering:
+			if _, taken := clients[e.c.nick]; taken {
+				e.result <- false
+				continue
+			}
+			e.c.room = defaultRoom
+			clients[e.c.nick] = e.c
+			e.result <- true
+			e.c.send(fmt.Sprintf("* Welcome, %s! You are in #%s. Type /help for commands.", e.c.nick, e.c.room))
+			toRoom(clients, e.c.room, e.c, fmt.Sprintf("* %s has arrived", e.c.nick))
+
+		case d := <-b.leaving:
+			delete(clients, d.c.nick)
+			d.c.send("* Bye (" + d.reason + ")")
+			toRoom(clients, d.c.room, nil, fmt.Sprintf("* %s has left (%s)", d.c.nick, d.reason))
+			close(d.c.out) // Only the broadcaster sends on it, so only it may close it; the writer goroutine then ends
+
+		case m := <-b.messages:
+			toRoom(clients, m.from.room, m.from, fmt.Sprintf("[#%s] %s: %s", m.from.room, m.from.nick, m.text))
+
+		case cmd := <-b.commands:
+			b.handle(clients, cmd)
+		}
+	}
+}
+
+func (b *broadcaster) handle(clients map[string]*client, cmd command) {
+	from := cmd.from
+	switch cmd.name {
+	case "/join":
+		room := strings.TrimPrefix(cmd.arg, "#")
+		if !validName(room) {
+			from.send("* Usage: /join <room>, with letters, digits, - and _ only")
+			return
+		}
+		if room == from.room {
+			from.send("* You are already in #" + room)
+			return
+		}
+		toRoom(clients, from.room, from, fmt.Sprintf("* %s went to #%s", from.nick, room))
+		from.room = room
+		toRoom(clients, room, from, fmt.Sprintf("* %s has joined", from.nick))
+		from.send(fmt.Sprintf("* You are now in #%s (%d here)", room, len(inRoom(clients, room))))
+
+	case "/help":
+		from.send("* Commands: /join <room>, /who, /msg <nick> <text>, /quit")
+
+	case "/who":
+		from.send(fmt.Sprintf("* In #%s: %s", from.room, strings.Join(inRoom(clients, from.room), ", ")))
+
+	case "/msg":
+		nick, text, _ := strings.Cut(cmd.arg, " ")
+		text = strings.TrimSpace(text)
+		if nick == "" || text == "" {
+			from.send("* Usage: /msg <nick> <text>")
+			return
+		}
+		to, ok := clients[nick]
+		if !ok {
+			from.send("* No such user: " + nick)
+			return
+		}
+		to.send(fmt.Sprintf("[private] %s: %s", from.nick, text))
+		if to != from {
+			from.send(fmt.Sprintf("[private to %s] %s", to.nick, text))
+		}
+	}
+}
+
+// toRoom sends line to everybody in room except skip (which may be nil).
+func toRoom(clients map[string]*client, room string, skip *client, line string) {
+	for _, c := range clients {
+		if c.room == room && c != skip {
+			c.send(line)
+		}
+	}
+}
+
+// inRoom lists the nicknames in room, sorted.
+func inRoom(clients map[string]*client, room string) []string {
+	var nicks []string
+	for _, nick := range slices.Sorted(maps.Keys(clients)) {
+		if clients[nick].room == room {
+			nicks = append(nicks, nick)
+		}
+	}
+	return nicks
+}
+
+// The helpers below hand requests to the broadcaster, giving up when it already stopped (the server is shutting down).
+
+func (b *broadcaster) enter(c *client) (ok, running bool) {
+	result := make(chan bool, 1)
+	select {
+	case b.entering <- entry{c: c, result: result}:
+		return <-result, true
+	case <-b.done:
+		return false, false
+	}
+}
+
+func (b *broadcaster) leave(c *client, reason string) {
+	select {
+	case b.leaving <- departure{c: c, reason: reason}:
+	case <-b.done:
+		close(c.out) // Nobody else will, and the writer goroutine is waiting on it
+	}
+}
+
+func (b *broadcaster) say(from *client, text string) {
+	select {
+	case b.messages <- message{from: from, text: text}:
+	case <-b.done:
+	}
+}
+
+func (b *broadcaster) command(from *client, name, arg string) {
+	select {
+	case b.commands <- command{from: from, name: name, arg: arg}:
+	case <-b.done:
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// Chat server from Chapter 8 of "The Go Programming Language" (section 8.10), with the exercises on top:
+// nicknames (8.14), idle clients disconnected (8.13) and slow clients skipped instead of slowing everybody down (8.15).
+// Also rooms and private messages. Any line-based client works:
+//
+//	go run ./cmd/chat -addr :8001
+//	go run ./cmd/netcat localhost:8001
+//
+// A signal cancels a context and closes the listener, as in cmd/tour5. The handlers then get a few seconds
+// to say goodbye before their connections are closed.
+func main() {
+	addr := flag.String("addr", "localhost:8001", "Address to listen on")
+	idle := flag.Duration("idle", 5*time.Minute, "Disconnect clients that send nothing for this long")
+	writeTimeout := flag.Duration("write-timeout", 5*time.Second, "Longest time a single write to a client may take")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "How long to wait for clients to be told about the shutdown before closing them")
+	flag.Parse()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		slog.Error("Failed to start listener", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("Chat server listening", "addr", listener.Addr().String(), "idle", *idle)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	srv := newServer(listener, *idle, *writeTimeout)
+	go srv.room.run(ctx)
+	go func() {
+		sig := <-signals
+		slog.Info("Shutting down server", "signal", sig.String())
+		cancel(fmt.Errorf("received signal %v", sig)) // Tells the broadcaster and every handler to stop, and why
+		listener.Close()
+	}()
+
+	srv.serve(ctx)
+
+	forced := srv.drain(*shutdownTimeout)
+	slog.Info("Server stopped", "forced", forced, "cause", context.Cause(ctx))
+}
+
+// server groups up what the goroutines below share, like the server of cmd/tour5.
+type server struct {
+	listener     net.Listener
+	room         *broadcaster
+	idle         time.Duration
+	writeTimeout time.Duration
+
+	wg      sync.WaitGroup // Running handlers, so shutdown can wait for them
+	running atomic.Int64   // How many, for the log when some have to be closed
+
+	// Cancelled once the shutdown deadline has passed. Each handler closes its own connection then,
+	// with a context.AfterFunc, so the server needs no list of open connections.
+	kill    context.Context
+	killAll context.CancelFunc
+}
+
+func newServer(listener net.Listener, idle, writeTimeout time.Duration) *server {
+	kill, killAll := context.WithCancel(context.Background())
+	return &server{
+		listener:     listener,
+		room:         newBroadcaster(),
+		idle:         idle,
+		writeTimeout: writeTimeout,
+		kill:         kill,
+		killAll:      killAll,
+	}
+}
+
+// client is one connected user. nick is set before entering and never changes;
+// room belongs to the broadcaster goroutine, nobody else reads or writes it.
+type client struct {
+	nick string
+	room string
+	out  chan string // Lines to write, drained by the client's writer goroutine
+}
+
+// Lines a client may have waiting before new ones get dropped (exercise 8.15)
+const outgoingBuffer = 32
+
+// send queues line without ever blocking the broadcaster: a client too slow to keep up misses lines instead.
+func (c *client) send(line string) {
+	select {
+	case c.out <- line:
+	default:
+	}
+}
+
+// serve accepts connections until ctx is cancelled.
+func (s *server) serve(ctx context.Context) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				slog.Info("Listener closed, connections loop exiting", "cause", context.Cause(ctx))
+				return
+			default:
+				slog.Error("Error accepting connection", "err", err)
+				continue
+			}
+		}
+		s.running.Add(1)
+		s.wg.Go(func() {
+			defer s.running.Add(-1)
+			s.handleConn(ctx, conn)
+		})
+	}
+}
+
+// handleConn asks for a nickname, then forwards every line to the broadcaster until the client leaves.
+func (s *server) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	log := slog.With("remote", conn.RemoteAddr().String())
+
+	// Reads block, and ctx.Done() cannot be selected on in the middle of one: an expired deadline wakes the read up instead
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	stopKill := context.AfterFunc(s.kill, func() { conn.Close() })
+	defer stopKill()
+
+	input := bufio.NewScanner(conn)
+	readLine := func() (string, bool) {
+		conn.SetReadDeadline(time.Now().Add(s.idle))
+		if ctx.Err() != nil {
+			return "", false // The idle deadline may have just replaced the one set on shutdown
+		}
+		if !input.Scan() {
+			return "", false
+		}
+		return strings.TrimSpace(input.Text()), true
+	}
+
+	// Nickname first. Until the client enters, nothing else writes to conn, so writing directly is fine.
+	c := &client{out: make(chan string, outgoingBuffer)}
+	for {
+		s.write(conn, "Choose a nickname: ")
+		nick, ok := readLine()
+		if !ok {
+			return // Gone (or idle, or shutdown) before entering, nobody to tell
+		}
+		if !validName(nick) {
+			s.write(conn, "* Nicknames have 1 to 20 letters, digits, - or _\n")
+			continue
+		}
+		c.nick = nick
+		entered, running := s.room.enter(c)
+		if !running {
+			s.write(conn, "* Server shutting down\n")
+			return
+		}
+		if entered {
+			break
+		}
+		s.write(conn, "* "+nick+" is taken\n")
+	}
+	log = log.With("nick", c.nick)
+	log.Info("Client entered")
+
+	// From here on only the writer goroutine writes to conn
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		s.writeLines(conn, c.out)
+	}()
+
+	reason := s.readCommands(c, readLine)
+	if ctx.Err() != nil {
+		reason = "server shutting down"
+	} else if errors.Is(input.Err(), os.ErrDeadlineExceeded) {
+		reason = fmt.Sprintf("idle for %v", s.idle)
+	}
+	s.room.leave(c, reason) // Closes c.out, ending the writer once everything queued was written
+	<-written
+	if ctx.Err() != nil {
+		s.write(conn, "* Server shutting down\n") // The broadcaster already stopped, so this one is written here
+	}
+	log.Info("Client left", "reason", reason)
+}
+
+// readCommands handles the lines of a client that entered, and returns why it stopped.
+func (s *server) readCommands(c *client, readLine func() (string, bool)) string {
+	for {
+		line, ok := readLine()
+		if !ok {
+			return "connection closed"
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			s.room.say(c, line)
+			continue
+		}
+
+		name, arg, _ := strings.Cut(line, " ")
+		name, arg = strings.ToLower(name), strings.TrimSpace(arg)
+		switch name {
+		case "/quit":
+			return "quit"
+		case "/join", "/who", "/msg", "/help":
+			s.room.command(c, name, arg)
+		default:
+			s.room.command(c, "/help", "") // Unknown command: showing the ones that exist
+		}
+	}
+}
+
+// writeLines writes every line of out to conn. After a failed write it keeps draining out without writing,
+// so whoever closes out is never kept waiting.
+func (s *server) writeLines(conn net.Conn, out <-chan string) {
+	failed := false
+	for line := range out {
+		if !failed {
+			failed = !s.write(conn, line+"\n")
+		}
+	}
+}
+
+// write writes text with a deadline, reporting whether it worked.
+func (s *server) write(conn net.Conn, text string) bool {
+	conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	_, err := io.WriteString(conn, text)
+	return err == nil
+}
+
+// validName accepts nicknames and room names: 1 to 20 letters, digits, '-' or '_'.
+func validName(name string) bool {
+	if name == "" || len(name) > 20 {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// drain waits for the handlers to finish. Those still running after timeout, stuck writing to a client
+// that does not read, have their connections closed, which ends them too.
+func (s *server) drain(timeout time.Duration) (forced int64) {
+	var closed atomic.Int64
+	deadline := time.AfterFunc(timeout, func() {
+		closed.Store(s.running.Load())
+		slog.Warn("Shutdown deadline exceeded, closing remaining connections", "timeout", timeout, "remaining", closed.Load())
+		s.killAll()
+	})
+	s.wg.Wait()
+	deadline.Stop()
+	return closed.Load()
+}
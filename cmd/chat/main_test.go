@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer runs a chat server on a loopback port, stopped when the test ends.
+func startServer(t *testing.T, idle time.Duration) (*server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(listener, idle, time.Second)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go srv.room.run(ctx)
+	done := make(chan struct{})
+	go func() {
+		srv.serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel(errors.New("test finished"))
+		listener.Close()
+		<-done
+		srv.drain(time.Second)
+	})
+	return srv, listener.Addr().String()
+}
+
+// chatClient is one user over loopback.
+type chatClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// join connects and enters as nick, returning once the welcome line arrived.
+func join(t *testing.T, addr, nick string) *chatClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &chatClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	prompt := make([]byte, len("Choose a nickname: "))
+	if _, err := io.ReadFull(c.r, prompt); err != nil || string(prompt) != "Choose a nickname: " {
+		t.Fatalf("prompt = %q, %v", prompt, err)
+	}
+	c.send(nick)
+	c.expect("* Welcome, " + nick + "! You are in #lobby. Type /help for commands.")
+	return c
+}
+
+func (c *chatClient) send(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads the next line, which must be want.
+func (c *chatClient) expect(want string) {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("waiting for %q: %v", want, err)
+	}
+	if got := strings.TrimSuffix(line, "\n"); got != want {
+		c.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// expectClosed reads until the server closes the connection, which must happen with nothing more to read.
+func (c *chatClient) expectClosed() {
+	c.t.Helper()
+	if rest, err := io.ReadAll(c.r); err != nil || len(rest) != 0 {
+		c.t.Errorf("after the last line: %q, %v; want the connection closed", rest, err)
+	}
+}
+
+func TestRooms(t *testing.T) {
+	_, addr := startServer(t, time.Minute)
+	alice := join(t, addr, "alice")
+	bob := join(t, addr, "bob")
+	alice.expect("* bob has arrived")
+
+	bob.send("/join games")
+	bob.expect("* You are now in #games (1 here)")
+	alice.expect("* bob went to #games")
+
+	// Rooms do not hear each other; /who answering right after shows nothing from the lobby came first
+	alice.send("anyone here?")
+	alice.send("/who")
+	alice.expect("* In #lobby: alice")
+	bob.send("/who")
+	bob.expect("* In #games: bob")
+
+	bob.send("/join #lobby")
+	bob.expect("* You are now in #lobby (2 here)")
+	alice.expect("* bob has joined")
+	bob.send("hello")
+	alice.expect("[#lobby] bob: hello")
+
+	bob.send("/quit")
+	bob.expect("* Bye (quit)")
+	bob.expectClosed()
+	alice.expect("* bob has left (quit)")
+}
+
+func TestNicknameTaken(t *testing.T) {
+	_, addr := startServer(t, time.Minute)
+	join(t, addr, "alice")
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "alice\nnot valid!\nalice2\n")
+	r := bufio.NewReader(conn)
+	want := "Choose a nickname: * alice is taken\n" +
+		"Choose a nickname: * Nicknames have 1 to 20 letters, digits, - or _\n" +
+		"Choose a nickname: * Welcome, alice2! You are in #lobby. Type /help for commands.\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil || string(got) != want {
+		t.Errorf("got %q, %v; want %q", got, err, want)
+	}
+}
+
+func TestIdleDisconnect(t *testing.T) {
+	_, addr := startServer(t, 200*time.Millisecond)
+	quiet := join(t, addr, "quiet")
+	talker := join(t, addr, "talker")
+	quiet.expect("* talker has arrived")
+
+	// talker keeps talking until quiet is cut off; it is then idle itself, and cut off in turn
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				io.WriteString(talker.conn, "/who\n")
+			}
+		}
+	}()
+	for {
+		line, err := quiet.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("quiet: %v before being told it was idle", err)
+		}
+		if line == "* Bye (idle for 200ms)\n" {
+			break
+		}
+	}
+	quiet.expectClosed()
+	for {
+		line, err := talker.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("talker: %v before hearing quiet left", err)
+		}
+		if line == "* quiet has left (idle for 200ms)\n" {
+			break
+		}
+	}
+	close(stop)
+}
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(listener, time.Minute, time.Second)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go srv.room.run(ctx)
+	done := make(chan struct{})
+	go func() {
+		srv.serve(ctx)
+		close(done)
+	}()
+
+	alice := join(t, listener.Addr().String(), "alice")
+	cancel(errors.New("test shutdown"))
+	listener.Close()
+	<-done
+	if forced := srv.drain(5 * time.Second); forced != 0 {
+		t.Errorf("%d connections closed by force, want every client told and gone", forced)
+	}
+	alice.expect("* Server shutting down")
+	alice.expectClosed()
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang_learning/clockclient"
+)
+
+// Load generator for the tour5 clock server: opens many connections at a steady pace, reads every tick
+// and checks it, then reports latencies, errors and what the server's own metrics did meanwhile.
+//
+//	go run ./cmd/tour5 -admin-addr localhost:9100
+//	go run ./cmd/clockload -conns 2000 -rate 200 -duration 30s -metrics http://localhost:9100/metrics localhost:8000
+//
+// Thousands of connections need as many file descriptors on both ends; Go raises the soft limit
+// (ulimit -n) up to the hard one on its own, beyond that it is up to the system.
+func main() {
+	conns := flag.Int("conns", 1000, "Number of concurrent connections to open")
+	rate := flag.Float64("rate", 100, "New connections per second while ramping up")
+	duration := flag.Duration("duration", 30*time.Second, "Length of the whole test, ramp-up included")
+	interval := flag.Duration("interval", time.Second, "Tick interval the server was started with")
+	timeout := flag.Duration("timeout", 5*time.Second, "Dial timeout, and longest silence before a connection counts as stalled")
+	precise := flag.Bool("precise", false, "Ask for RFC 3339 lines with nanoseconds (FORMAT command), so latency is measured against the tick itself")
+	location := flag.String("tz", "Local", "Time zone the server formats its ticks in (only matters for 15:04:05 lines)")
+	metricsURL := flag.String("metrics", "", "URL of the server's /metrics, to report goroutines and memory (e.g. http://localhost:9100/metrics)")
+	settle := flag.Duration("settle", 3*time.Second, "How long to wait after closing every connection before the last metrics scrape")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: clockload [flags] host:port")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *conns <= 0 || *rate <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	loc, err := time.LoadLocation(*location)
+	if err != nil {
+		log.Fatalln("Invalid time zone:", err)
+	}
+	addr := flag.Arg(0)
+
+	// Ctrl+C stops the test early, the report is still printed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	var scraper *scraper
+	if *metricsURL != "" {
+		scraper = newScraper(*metricsURL)
+		scraper.scrape() // Baseline, before any of our connections exist
+		go scraper.run(ctx, time.Second)
+	}
+
+	spec := clientSpec{addr: addr, interval: *interval, timeout: *timeout, precise: *precise, location: loc}
+	fanout := newFanout()
+	results := make(chan result, *conns)
+
+	// Ramp-up: one new connection every 1/rate seconds, each one in its own goroutine until the test ends.
+	// https://pkg.go.dev/sync#WaitGroup.Go
+	var wg sync.WaitGroup
+	started := time.Now()
+	pace := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	opened := 0
+ramp:
+	for opened < *conns {
+		wg.Go(func() { results <- spec.run(ctx, fanout) })
+		opened++
+		select {
+		case <-pace.C:
+		case <-ctx.Done():
+			break ramp
+		}
+	}
+	pace.Stop()
+	rampUp := time.Since(started)
+
+	wg.Wait()
+	close(results)
+
+	var total summary
+	for r := range results {
+		total.add(r)
+	}
+
+	if scraper != nil {
+		time.Sleep(*settle) // The server only notices a client left when its next write fails
+		scraper.scrape()
+	}
+
+	fmt.Printf("target:        %s\n", addr)
+	fmt.Printf("connections:   %d opened in %v (%.0f/s)\n", opened, rampUp.Round(time.Millisecond), float64(opened)/rampUp.Seconds())
+	total.report(os.Stdout, fanout, *precise)
+	if scraper != nil {
+		scraper.report(os.Stdout)
+	}
+}
+
+// clientSpec is what every connection does, shared by all of them.
+type clientSpec struct {
+	addr     string
+	interval time.Duration
+	timeout  time.Duration
+	precise  bool
+	location *time.Location
+}
+
+// result is what one connection saw, handed back when it ends.
+type result struct {
+	setup      time.Duration   // Time to connect
+	firstTick  time.Duration   // Time from connecting to the first line
+	latencies  []time.Duration // Scheduled ticks only: arrival minus the time in the line
+	ticks      int
+	missed     int
+	duplicated int
+	failure    string // Why the connection ended before the test did, empty if it lasted
+}
+
+// run opens one connection and reads from it until ctx ends.
+func (spec clientSpec) run(ctx context.Context, fanout *fanout) (r result) {
+	dialer := net.Dialer{Timeout: spec.timeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", spec.addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return r // Still dialing when the test ended, nothing to blame the server for
+		}
+		r.failure = "dial: " + clockclient.ShortError(err)
+		return r
+	}
+	r.setup = time.Since(start)
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() }) // Unblocks the read below when the test ends
+	defer stop()
+
+	if spec.precise {
+		if _, err := io.WriteString(conn, "FORMAT rfc3339nano\n"); err != nil {
+			r.failure = "write: " + clockclient.ShortError(err)
+			return r
+		}
+	}
+
+	var last time.Time
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(spec.timeout))
+		line, err := reader.ReadString('\n')
+		arrived := time.Now()
+		if err != nil {
+			switch {
+			case ctx.Err() != nil:
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				r.failure = "stalled: no line for " + spec.timeout.String()
+			case errors.Is(err, io.EOF):
+				r.failure = "closed by server"
+			default:
+				r.failure = "read: " + clockclient.ShortError(err)
+			}
+			return r
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "ERR"):
+			r.failure = "refused: " + line // e.g. "ERR server full, try again later"
+			return r
+		case strings.HasPrefix(line, "OK"):
+			last = time.Time{} // Reply to FORMAT; the format changed, so the next tick starts the sequence over
+			continue
+		}
+
+		tick, err := clockclient.ParseTick(line, arrived, spec.location)
+		if err != nil {
+			r.failure = fmt.Sprintf("invalid line %q", line)
+			return r
+		}
+		r.ticks++
+		if r.ticks == 1 {
+			r.firstTick = arrived.Sub(start)
+			continue // Sent right away on connect, not on the server's schedule: no latency, no gap
+		}
+		r.latencies = append(r.latencies, arrived.Sub(tick))
+		fanout.arrived(tick, arrived)
+
+		if !last.IsZero() {
+			gap := tick.Sub(last)
+			switch steps := int(math.Round(float64(gap) / float64(spec.interval))); {
+			case gap <= 0:
+				r.duplicated++
+			case steps > 1:
+				r.missed += steps - 1
+			}
+		}
+		last = tick
+	}
+}
+
+// fanout records when each tick reached its first and its last connection: the spread between them
+// is how long the server takes to hand one tick to everybody.
+type fanout struct {
+	mu    sync.Mutex
+	ticks map[int64]*arrivals // By the tick's Unix time in nanoseconds: time.Time values are not reliable map keys
+}
+
+type arrivals struct {
+	first, last time.Time
+	count       int
+}
+
+func newFanout() *fanout {
+	return &fanout{ticks: make(map[int64]*arrivals)}
+}
+
+func (f *fanout) arrived(tick, at time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a, ok := f.ticks[tick.UnixNano()]
+	if !ok {
+		f.ticks[tick.UnixNano()] = &arrivals{first: at, last: at, count: 1}
+		return
+	}
+	a.first, a.last = minTime(a.first, at), maxTime(a.last, at)
+	a.count++
+}
+
+// spreads returns the spread of every tick that reached more than one connection.
+func (f *fanout) spreads() []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var spreads []time.Duration
+	for _, a := range f.ticks {
+		if a.count > 1 {
+			spreads = append(spreads, a.last.Sub(a.first))
+		}
+	}
+	return spreads
+}
+
+// summary adds up the results of every connection.
+type summary struct {
+	connected  int
+	setups     []time.Duration
+	firstTicks []time.Duration
+	latencies  []time.Duration
+	ticks      int
+	missed     int
+	duplicated int
+	failures   map[string]int
+}
+
+func (s *summary) add(r result) {
+	if r.setup > 0 {
+		s.connected++
+		s.setups = append(s.setups, r.setup)
+	}
+	if r.firstTick > 0 {
+		s.firstTicks = append(s.firstTicks, r.firstTick)
+	}
+	s.latencies = append(s.latencies, r.latencies...)
+	s.ticks += r.ticks
+	s.missed += r.missed
+	s.duplicated += r.duplicated
+	if r.failure != "" {
+		if s.failures == nil {
+			s.failures = make(map[string]int)
+		}
+		s.failures[r.failure]++
+	}
+}
+
+func (s *summary) report(w io.Writer, fanout *fanout, precise bool) {
+	fmt.Fprintf(w, "connected:     %d\n", s.connected)
+	fmt.Fprintf(w, "ticks read:    %d (missed %d, duplicated %d)\n", s.ticks, s.missed, s.duplicated)
+	printPercentiles(w, "setup:", s.setups)
+	printPercentiles(w, "first tick:", s.firstTicks)
+	printPercentiles(w, "tick latency:", s.latencies)
+	if !precise {
+		// "15:04:05" only says which second a tick belongs to, so the latency counts from the second boundary
+		// and includes how far into the second the server's ticker fires
+		fmt.Fprintln(w, "               (from the second boundary; -precise measures delivery alone)")
+	}
+	printPercentiles(w, "fan-out:", fanout.spreads())
+
+	errorCount := 0
+	for _, n := range s.failures {
+		errorCount += n
+	}
+	fmt.Fprintf(w, "errors:        %d\n", errorCount)
+	for _, failure := range slices.Sorted(maps.Keys(s.failures)) {
+		fmt.Fprintf(w, "  %6d  %s\n", s.failures[failure], failure)
+	}
+}
+
+func printPercentiles(w io.Writer, label string, values []time.Duration) {
+	if len(values) == 0 {
+		fmt.Fprintf(w, "%-14s no samples\n", label)
+		return
+	}
+	sorted := slices.Sorted(slices.Values(values))
+	fmt.Fprintf(w, "%-14s p50 %v  p90 %v  p99 %v  max %v\n", label,
+		clockclient.Round(clockclient.Percentile(sorted, 50)), clockclient.Round(clockclient.Percentile(sorted, 90)), clockclient.Round(clockclient.Percentile(sorted, 99)), clockclient.Round(sorted[len(sorted)-1]))
+}
+
+// scraper reads the server's Prometheus metrics: before the test, once a second during it, and after it.
+type scraper struct {
+	url    string
+	client http.Client
+
+	mu      sync.Mutex
+	samples []map[string]float64
+	errors  int
+}
+
+// Metrics worth reporting, all plain gauges or counters without labels
+var scrapedMetrics = []string{
+	"go_goroutines",
+	"go_memstats_heap_inuse_bytes",
+	"go_memstats_sys_bytes",
+	"clock_connections_active",
+	"clock_connections_total",
+	"clock_accept_errors_total",
+}
+
+func newScraper(url string) *scraper {
+	return &scraper{url: url, client: http.Client{Timeout: 2 * time.Second}}
+}
+
+func (s *scraper) run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.scrape()
+		}
+	}
+}
+
+func (s *scraper) scrape() {
+	values, err := s.fetch()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.samples = append(s.samples, values)
+}
+
+// fetch reads the text format line by line, keeping "name value" lines of the metrics we care about.
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+func (s *scraper) fetch() (map[string]float64, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, raw, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || !slices.Contains(scrapedMetrics, name) {
+			continue
+		}
+		if value, err := strconv.ParseFloat(raw, 64); err == nil {
+			values[name] = value
+		}
+	}
+	return values, scanner.Err()
+}
+
+// report prints each metric before the test, at its peak during it, and after it.
+// Goroutines and connections that do not go back down afterwards point at a leak.
+func (s *scraper) report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) < 2 {
+		fmt.Fprintf(w, "server metrics: not enough scrapes (%d failed)\n", s.errors)
+		return
+	}
+	before, after := s.samples[0], s.samples[len(s.samples)-1]
+	fmt.Fprintf(w, "server metrics (%d scrapes, %d failed):\n", len(s.samples), s.errors)
+	fmt.Fprintf(w, "  %-30s %14s %14s %14s\n", "", "before", "peak", "after")
+	for _, name := range scrapedMetrics {
+		peak := math.Inf(-1)
+		for _, sample := range s.samples {
+			peak = max(peak, sample[name])
+		}
+		fmt.Fprintf(w, "  %-30s %14s %14s %14s\n", name, formatValue(name, before[name]), formatValue(name, peak), formatValue(name, after[name]))
+	}
+}
+
+func formatValue(name string, v float64) string {
+	if strings.HasSuffix(name, "_bytes") {
+		return fmt.Sprintf("%.1f MiB", v/(1<<20))
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
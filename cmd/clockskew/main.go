@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang_learning/clockclient"
+)
+
+// Measures how far this machine's clock is from a tour5 server's, by timestamping every tick on arrival:
+//
+//	go run ./cmd/clockskew -duration 30s localhost:8000
+//	go run ./cmd/clockskew -precise -csv skew.csv localhost:8000
+//
+// With the default "15:04:05" lines the server only tells the second, so a single offset is only good to
+// about half a second. -precise asks the server for RFC 3339 lines with nanoseconds (FORMAT command), which
+// turns the offset into a real measurement, off only by the one-way network delay.
+func main() {
+	duration := flag.Duration("duration", time.Minute, "How long to measure, 0 means until Ctrl+C")
+	location := flag.String("tz", "Local", "Time zone the server formats its ticks in (only matters for 15:04:05 lines)")
+	precise := flag.Bool("precise", false, "Ask the server for RFC 3339 lines with nanoseconds instead of whole seconds")
+	csvPath := flag.String("csv", "", "Also write every sample to this CSV file, for graphing")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: clockskew [flags] host:port")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	loc, err := time.LoadLocation(*location)
+	if err != nil {
+		log.Fatalln("Invalid time zone:", err)
+	}
+
+	// Ctrl+C ends the measurement early, but the report is still printed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	var samplesCSV *csv.Writer
+	if *csvPath != "" {
+		f, err := os.Create(*csvPath)
+		if err != nil {
+			log.Fatalln("Cannot create CSV file:", err)
+		}
+		defer f.Close()
+		samplesCSV = csv.NewWriter(f)
+		defer samplesCSV.Flush()
+		samplesCSV.Write([]string{"seq", "local_time", "server_time", "offset_seconds", "gap_seconds"})
+	}
+
+	samples, err := measure(ctx, flag.Arg(0), *precise, loc, samplesCSV)
+	if err != nil && len(samples) == 0 {
+		log.Fatalln(err)
+	}
+	if err != nil {
+		log.Println("Measurement ended early:", err)
+	}
+	report(os.Stdout, samples, *precise)
+}
+
+// sample is one tick: the time the server put in the line, and the time it arrived here.
+type sample struct {
+	local  time.Time
+	server time.Time
+}
+
+// offset is how far the server's clock is ahead of ours (negative: behind), network delay included.
+func (s sample) offset() time.Duration {
+	return s.server.Sub(s.local)
+}
+
+// measure collects samples from the server at addr until ctx ends.
+func measure(ctx context.Context, addr string, precise bool, loc *time.Location, samplesCSV *csv.Writer) ([]sample, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Closing the connection is the only way to unblock a pending read, so it is done when ctx ends.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if precise {
+		if _, err := io.WriteString(conn, "FORMAT rfc3339nano\n"); err != nil {
+			return nil, err
+		}
+	}
+
+	// With -precise, ticks that arrive before the reply to FORMAT still use the old format and are skipped
+	waiting := precise
+
+	var samples []sample
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		local := time.Now() // As early as possible, every line of code before this adds to the measured offset
+		line := scanner.Text()
+		if strings.HasPrefix(line, "ERR") {
+			return samples, fmt.Errorf("server refused the command: %s", line)
+		}
+		if strings.HasPrefix(line, "OK") {
+			waiting = false
+			continue // Reply to the FORMAT command, not a tick
+		}
+		if waiting {
+			continue
+		}
+		server, err := clockclient.ParseTick(line, local, loc)
+		if err != nil {
+			return samples, fmt.Errorf("unexpected line %q: %w", line, err)
+		}
+
+		s := sample{local: local, server: server}
+		samples = append(samples, s)
+		if samplesCSV != nil {
+			gap := ""
+			if len(samples) > 1 {
+				gap = strconv.FormatFloat(server.Sub(samples[len(samples)-2].server).Seconds(), 'f', 9, 64)
+			}
+			samplesCSV.Write([]string{
+				strconv.Itoa(len(samples)),
+				local.Format(time.RFC3339Nano),
+				server.Format(time.RFC3339Nano),
+				strconv.FormatFloat(s.offset().Seconds(), 'f', 9, 64),
+				gap,
+			})
+		}
+	}
+	if ctx.Err() != nil {
+		return samples, nil // The measurement window ended (or Ctrl+C), closing the connection was our doing
+	}
+	if err := scanner.Err(); err != nil {
+		return samples, err
+	}
+	return samples, errors.New("server closed the connection")
+}
+
+// report prints offset and jitter percentiles, and the seconds that were missed or repeated.
+func report(w io.Writer, samples []sample, precise bool) {
+	fmt.Fprintf(w, "samples:    %d\n", len(samples))
+	if len(samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "window:     %v\n", samples[len(samples)-1].local.Sub(samples[0].local).Round(time.Millisecond))
+
+	offsets := make([]time.Duration, len(samples))
+	for i, s := range samples {
+		offsets[i] = s.offset()
+	}
+	if !precise {
+		// The server sent second N somewhere between N.000 and N.999 on its own clock, so on average it is half a second
+		// later than the line says. Correcting for that keeps the estimate centered; it is still only good to ±0.5s.
+		for i := range offsets {
+			offsets[i] += 500 * time.Millisecond
+		}
+		fmt.Fprintln(w, "resolution: ±500ms (whole-second lines, use -precise for more)")
+	}
+	printPercentiles(w, "offset:", offsets)
+
+	// The first tick is sent as soon as the connection opens, not on the server's schedule, so gaps start at the second one.
+	ticks := samples[1:]
+	if len(ticks) < 3 {
+		fmt.Fprintln(w, "gaps:       not enough ticks to measure jitter")
+		return
+	}
+
+	// The interval is whatever the server used most; the median gap is a good guess without having to be told
+	var serverGaps []time.Duration
+	for i := 1; i < len(ticks); i++ {
+		serverGaps = append(serverGaps, ticks[i].server.Sub(ticks[i-1].server))
+	}
+	interval := clockclient.Percentile(slices.Sorted(slices.Values(serverGaps)), 50)
+	if interval <= 0 {
+		fmt.Fprintln(w, "gaps:       the server repeats the same time, cannot measure jitter")
+		return
+	}
+	fmt.Fprintf(w, "interval:   %v\n", interval)
+
+	// Jitter: how much the time between two arrivals differs from the time between the same two ticks on the server.
+	// Missed and duplicated: server gaps that are more than one interval, or zero.
+	var jitter []time.Duration
+	missed, duplicated := 0, 0
+	for i := 1; i < len(ticks); i++ {
+		serverGap := serverGaps[i-1]
+		localGap := ticks[i].local.Sub(ticks[i-1].local)
+		jitter = append(jitter, clockclient.AbsDuration(localGap-serverGap))
+
+		switch steps := int(math.Round(float64(serverGap) / float64(interval))); {
+		case serverGap <= 0:
+			duplicated++
+		case steps > 1:
+			missed += steps - 1
+		}
+	}
+	printPercentiles(w, "jitter:", jitter)
+	fmt.Fprintf(w, "missed:     %d\n", missed)
+	fmt.Fprintf(w, "duplicated: %d\n", duplicated)
+}
+
+func printPercentiles(w io.Writer, label string, values []time.Duration) {
+	sorted := slices.Sorted(slices.Values(values))
+	var sum time.Duration
+	for _, v := range sorted {
+		sum += v
+	}
+	fmt.Fprintf(w, "%-11s min %v  p50 %v  p90 %v  p99 %v  max %v  mean %v\n", label,
+		clockclient.Round(sorted[0]), clockclient.Round(clockclient.Percentile(sorted, 50)), clockclient.Round(clockclient.Percentile(sorted, 90)),
+		clockclient.Round(clockclient.Percentile(sorted, 99)), clockclient.Round(sorted[len(sorted)-1]), clockclient.Round(sum/time.Duration(len(sorted))))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang_learning/clockclient"
+)
+
+// Second half of the "clock wall" exercise (8.1) from Chapter 8 of "The Go Programming Language".
+// It connects to several tour5 servers at the same time and shows their clocks side by side:
+//
+//	go run ./cmd/clockwall NewYork=localhost:8010 Tokyo=localhost:8020 London=localhost:8030
+func main() {
+	staleAfter := flag.Duration("stale", 3*time.Second, "Mark a clock as stale when nothing arrives for this long")
+	maxBackoff := flag.Duration("max-backoff", 10*time.Second, "Longest wait between reconnection attempts")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: clockwall [flags] Name=host:port ...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	clocks, err := parseClocks(flag.Args())
+	if err != nil {
+		log.Println(err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Cancelled on Ctrl+C, which stops every watcher at once
+	// https://pkg.go.dev/os/signal#NotifyContext
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// One goroutine per server, all of them reporting to the same channel.
+	// Only main touches "clocks", so there is no need for a mutex.
+	updates := make(chan update)
+	for i, c := range clocks {
+		go watch(ctx, i, c.addr, *maxBackoff, updates)
+	}
+
+	// Redrawing on a ticker as well, so a clock that goes quiet is marked as stale even when no update arrives.
+	redraw := time.NewTicker(500 * time.Millisecond)
+	defer redraw.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return
+		case u := <-updates:
+			clocks[u.index].apply(u)
+		case <-redraw.C:
+		}
+		draw(clocks, *staleAfter)
+	}
+}
+
+// clock is the last known state of one server.
+type clock struct {
+	name, addr string
+	line       string    // Last line received
+	lastSeen   time.Time // When it was received
+	connected  bool
+	problem    string // Why the clock is not connected, if it is not
+}
+
+// update is what a watcher tells main: a new line, or a change in the connection.
+type update struct {
+	index     int
+	line      string
+	connected bool
+	err       error
+}
+
+func (c *clock) apply(u update) {
+	c.connected = u.connected
+	switch {
+	case u.err != nil:
+		c.problem = u.err.Error()
+	case u.line != "":
+		c.line = u.line
+		c.lastSeen = time.Now()
+		c.problem = ""
+	}
+}
+
+func (c *clock) status(staleAfter time.Duration) string {
+	switch {
+	case !c.connected && c.problem != "":
+		return "stale (" + c.problem + ")"
+	case !c.connected:
+		return "connecting..."
+	case c.lastSeen.IsZero():
+		return "waiting for first tick"
+	case time.Since(c.lastSeen) > staleAfter:
+		return fmt.Sprintf("stale (silent for %v)", time.Since(c.lastSeen).Round(time.Second))
+	default:
+		return "live"
+	}
+}
+
+func parseClocks(args []string) ([]clock, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("at least one Name=host:port argument is needed")
+	}
+	clocks := make([]clock, 0, len(args))
+	for _, arg := range args {
+		name, addr, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid argument %q, expected Name=host:port", arg)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid address for %s: %w", name, err)
+		}
+		clocks = append(clocks, clock{name: name, addr: addr})
+	}
+	return clocks, nil
+}
+
+// watch keeps one server connected, reconnecting with exponential backoff when it goes away.
+func watch(ctx context.Context, index int, addr string, maxBackoff time.Duration, updates chan<- update) {
+	var dialer net.Dialer
+	backoff := 500 * time.Millisecond
+
+	report := func(u update) bool {
+		u.index = index
+		select {
+		case updates <- u:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			backoff = 500 * time.Millisecond // Connected again, so the next failure starts over
+			if !report(update{connected: true}) {
+				conn.Close()
+				return
+			}
+			err = readClock(ctx, conn, report)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !report(update{err: fmt.Errorf("%v, retrying in %v", clockclient.ShortError(err), backoff)}) {
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// readClock forwards every line of a connection until it ends.
+func readClock(ctx context.Context, conn net.Conn, report func(update) bool) error {
+	defer conn.Close()
+
+	// Closing the connection is the only way to unblock a pending read, so it is done when ctx ends.
+	// https://pkg.go.dev/context#AfterFunc
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if !report(update{connected: true, line: scanner.Text()}) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("server closed the connection")
+}
+
+func draw(clocks []clock, staleAfter time.Duration) {
+	// ANSI escape codes: move the cursor to the top left corner and clear the screen
+	// https://en.wikipedia.org/wiki/ANSI_escape_code
+	fmt.Print("\033[H\033[2J")
+
+	// tabwriter lines up the columns, no matter how long each name or status is
+	// https://pkg.go.dev/text/tabwriter
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CLOCK\tADDRESS\tTIME\tSTATUS")
+	for _, c := range clocks {
+		line := c.line
+		if line == "" {
+			line = "--:--:--"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.name, c.addr, line, c.status(staleAfter))
+	}
+	w.Flush()
+}
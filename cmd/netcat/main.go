@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// A small "nc" clone, based on the netcat examples from Chapter 8 of "The Go Programming Language".
+// Whatever is typed goes to the server, whatever the server sends is printed, both at the same time:
+//
+//	go run ./cmd/netcat localhost:8000
+//	printf 'TZ Asia/Tokyo\nQUIT\n' | go run ./cmd/netcat -timestamp localhost:8000
+func main() {
+	reconnect := flag.Bool("reconnect", false, "Reconnect with exponential backoff when the connection fails or the server closes it")
+	maxBackoff := flag.Duration("max-backoff", 10*time.Second, "Longest wait between reconnection attempts")
+	timestamp := flag.Bool("timestamp", false, "Prefix every received line with the local time it arrived")
+	readTimeout := flag.Duration("read-timeout", 0, "Give up when the server sends nothing for this long (0 waits forever)")
+
+	var tlsOpts tlsOptions
+	flag.BoolVar(&tlsOpts.enabled, "tls", false, "Connect using TLS")
+	flag.StringVar(&tlsOpts.caFile, "tls-ca", "", "CA file (PEM) to verify the server with, instead of the system roots")
+	flag.StringVar(&tlsOpts.certFile, "tls-cert", "", "Client certificate file (PEM), for servers that require mutual TLS")
+	flag.StringVar(&tlsOpts.keyFile, "tls-key", "", "Private key file (PEM) of -tls-cert")
+	flag.StringVar(&tlsOpts.serverName, "tls-server-name", "", "Name expected in the server certificate, the host of the address by default")
+	flag.BoolVar(&tlsOpts.insecure, "tls-insecure", false, "Do not verify the server certificate (e.g. a server using -tls-self-signed)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: netcat [flags] host:port")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	addr := "localhost:8000"
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.NArg() == 1 {
+		addr = flag.Arg(0)
+	}
+
+	tlsCfg, err := tlsOpts.config(addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// stdin is read by a single goroutine for the whole program, so nothing typed is lost between reconnections
+	input := make(chan []byte)
+	go readInput(os.Stdin, input)
+
+	c := client{addr: addr, tls: tlsCfg, timestamp: *timestamp, readTimeout: *readTimeout}
+	backoff := 500 * time.Millisecond
+	for {
+		err := c.run(input)
+		if err == nil && c.inputDone.Load() {
+			return // Both sides are done: we sent everything and the server closed the connection
+		}
+		if !*reconnect {
+			if err != nil {
+				log.Fatalln(err)
+			}
+			return
+		}
+		if err == nil {
+			err = errors.New("server closed the connection")
+		}
+		if c.connected {
+			backoff = 500 * time.Millisecond // The last attempt worked for a while, so starting over
+		}
+		log.Printf("%v, reconnecting in %v...", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, *maxBackoff)
+	}
+}
+
+type client struct {
+	addr        string
+	tls         *tls.Config // nil for plain TCP
+	timestamp   bool
+	readTimeout time.Duration
+
+	connected bool        // Whether the last run got to connect at all
+	inputDone atomic.Bool // Whether stdin already ended, set by the writer goroutine
+	pending   []byte      // Taken from stdin but not written when the last connection ended, sent first on the next one
+}
+
+// run connects once and copies data in both directions until the server stops sending.
+// A nil error means the server closed the connection on its side (EOF).
+func (c *client) run(input <-chan []byte) error {
+	c.connected = false
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.connected = true
+
+	// Copying stdin to the connection in the background...
+	done := make(chan struct{})
+	writeErr := make(chan error, 1)
+	go func() { writeErr <- c.send(conn, input, done) }()
+
+	// ...while the connection is copied to stdout here
+	var src io.Reader = conn
+	if c.readTimeout > 0 {
+		src = &deadlineReader{conn: conn, timeout: c.readTimeout}
+	}
+	if c.timestamp {
+		err = copyLines(os.Stdout, src)
+	} else {
+		_, err = io.Copy(os.Stdout, src)
+	}
+
+	// The writer has to be gone before returning: left running, it could take the next chunk from input
+	// and write it to this dead connection, while the next one never sees it. Closing conn ends a write in progress.
+	close(done)
+	conn.Close()
+	if wErr := <-writeErr; err == nil && wErr != nil && !errors.Is(wErr, net.ErrClosed) {
+		err = wErr
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("nothing received for %v", c.readTimeout)
+	}
+	return err
+}
+
+func (c *client) dial() (net.Conn, error) {
+	if c.tls == nil {
+		return net.Dial("tcp", c.addr)
+	}
+	// tls.Dial also runs the handshake, so certificate problems show up here and not on the first read
+	return tls.Dial("tcp", c.addr, c.tls)
+}
+
+// send writes stdin chunks to conn, starting with the one the previous connection could not write.
+// A chunk that fails to write is kept in c.pending, so reconnecting loses nothing typed.
+// When stdin ends, only the write side is closed (half-close):
+// the server sees EOF, but can keep sending until it decides to close too.
+// Over TLS, CloseWrite sends a close_notify alert, which the server reads as EOF as well.
+// https://pkg.go.dev/net#TCPConn.CloseWrite
+func (c *client) send(conn net.Conn, input <-chan []byte, done <-chan struct{}) error {
+	for {
+		if c.pending == nil {
+			select {
+			case chunk, ok := <-input:
+				if !ok {
+					c.inputDone.Store(true)
+					// An interface with just the method needed, so any connection type that can half-close works
+					if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+						return hc.CloseWrite()
+					}
+					return nil
+				}
+				c.pending = chunk
+			case <-done:
+				return nil
+			}
+		}
+		// select picks at random when both are ready: the chunk may have come in just as the connection ended
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		n, err := conn.Write(c.pending)
+		if err != nil {
+			c.pending = c.pending[n:] // What did get written is not sent twice
+			return err
+		}
+		c.pending = nil
+	}
+}
+
+// readInput sends everything read from r to chunks, closing it at EOF.
+func readInput(r io.Reader, chunks chan<- []byte) {
+	defer close(chunks)
+	for {
+		buf := make([]byte, 4096) // A new buffer every time, the previous one may still be in use by the writer
+		n, err := r.Read(buf)
+		if n > 0 {
+			chunks <- buf[:n]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// copyLines copies src to dst line by line, adding the local arrival time in front of each one.
+func copyLines(dst io.Writer, src io.Reader) error {
+	reader := bufio.NewReader(src)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			fmt.Fprintf(dst, "%s %s", time.Now().Format("2006-01-02T15:04:05.000"), line)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deadlineReader pushes the read deadline forward before every read, turning it into an idle timeout.
+// https://pkg.go.dev/net#Conn (SetReadDeadline)
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReconnectKeepsInput has the server hang up after the first line, and checks the rest of the input
+// goes to the next connection instead of the one that ended.
+func TestReconnectKeepsInput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	accept := func() net.Conn {
+		t.Helper()
+		select {
+		case conn := <-accepted:
+			t.Cleanup(func() { conn.Close() })
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatal("client did not connect")
+			return nil
+		}
+	}
+
+	// The loop of main, without the backoff
+	input := make(chan []byte)
+	c := client{addr: listener.Addr().String()}
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for !c.inputDone.Load() {
+			c.run(input)
+		}
+	}()
+
+	first := accept()
+	input <- []byte("first\n")
+	got := make([]byte, len("first\n"))
+	if _, err := io.ReadFull(first, got); err != nil || string(got) != "first\n" {
+		t.Fatalf("first connection read %q, %v", got, err)
+	}
+	first.Close()
+
+	// The client reconnecting means its first run returned: what comes next is for the second connection only
+	second := accept()
+	input <- []byte("second\n")
+	input <- []byte("third\n")
+	close(input)
+	rest, err := io.ReadAll(second) // Until the half-close that follows the end of the input
+	if err != nil || string(rest) != "second\nthird\n" {
+		t.Errorf("second connection read %q, %v; want the rest of the input", rest, err)
+	}
+	second.Close()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Error("client still running after the input ended and the server closed")
+	}
+}
+
+func TestSendKeepsUnwrittenChunk(t *testing.T) {
+	var c client
+	input := make(chan []byte, 1)
+	input <- []byte("hello\n")
+
+	// A connection that is already closed: the chunk cannot be written, so it waits for the next one
+	dead, other := net.Pipe()
+	dead.Close()
+	other.Close()
+	if err := c.send(dead, input, make(chan struct{})); err == nil {
+		t.Fatal("send on a closed connection returned no error")
+	}
+	if string(c.pending) != "hello\n" {
+		t.Fatalf("pending = %q, want the chunk that was not written", c.pending)
+	}
+
+	conn, server := net.Pipe()
+	defer conn.Close()
+	defer server.Close()
+	close(input)
+	go c.send(conn, input, make(chan struct{}))
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len("hello\n"))
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "hello\n" {
+		t.Errorf("next connection read %q, %v; want the pending chunk first", got, err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// tlsOptions are the -tls* flags of the client.
+type tlsOptions struct {
+	enabled    bool
+	caFile     string // CA the server certificate must be signed by, the system roots when empty
+	certFile   string // Client certificate and key, for servers that require mutual TLS
+	keyFile    string
+	serverName string // Name checked against the server certificate, the host of the address when empty
+	insecure   bool   // Skip verification, e.g. for a server using -tls-self-signed
+}
+
+// config builds the client TLS configuration for addr, or returns nil when TLS is disabled.
+// https://pkg.go.dev/crypto/tls#Config
+func (o tlsOptions) config(addr string) (*tls.Config, error) {
+	if !o.enabled {
+		// Any -tls-* flag without -tls is refused, rather than quietly connecting in plain text
+		if o.caFile != "" || o.certFile != "" || o.keyFile != "" || o.serverName != "" || o.insecure {
+			return nil, errors.New("the -tls-* options need -tls")
+		}
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         o.serverName,
+		InsecureSkipVerify: o.insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+
+	if o.caFile != "" {
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", o.caFile)
+		}
+	}
+
+	if (o.certFile == "") != (o.keyFile == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be used together")
+	}
+	if o.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTLSOptionsConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       tlsOptions
+		off        bool   // No TLS configuration
+		serverName string // Expected when TLS is on
+		err        string // Part of the error, empty when the options are valid
+	}{
+		{name: "no TLS", off: true},
+		{name: "TLS", opts: tlsOptions{enabled: true}, serverName: "clock.example"},
+		{name: "server name", opts: tlsOptions{enabled: true, serverName: "other.example"}, serverName: "other.example"},
+		{name: "insecure", opts: tlsOptions{enabled: true, insecure: true}, serverName: "clock.example"},
+		{name: "CA without TLS", opts: tlsOptions{caFile: "ca.pem"}, err: "need -tls"},
+		{name: "certificate without TLS", opts: tlsOptions{certFile: "client.pem"}, err: "need -tls"},
+		{name: "key without TLS", opts: tlsOptions{keyFile: "client.key"}, err: "need -tls"},
+		{name: "server name without TLS", opts: tlsOptions{serverName: "other.example"}, err: "need -tls"},
+		{name: "insecure without TLS", opts: tlsOptions{insecure: true}, err: "need -tls"},
+		{name: "key without certificate", opts: tlsOptions{enabled: true, keyFile: "client.key"}, err: "must be used together"},
+		{name: "certificate without key", opts: tlsOptions{enabled: true, certFile: "client.pem"}, err: "must be used together"},
+		{name: "missing CA file", opts: tlsOptions{enabled: true, caFile: "/nonexistent/ca.pem"}, err: "reading CA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.opts.config("clock.example:8000")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("config error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.off {
+				if cfg != nil {
+					t.Errorf("config = %+v, want nil for plain TCP", cfg)
+				}
+				return
+			}
+			if cfg.ServerName != tt.serverName || cfg.InsecureSkipVerify != tt.opts.insecure {
+				t.Errorf("ServerName %q, InsecureSkipVerify %v; want %q, %v", cfg.ServerName, cfg.InsecureSkipVerify, tt.serverName, tt.opts.insecure)
+			}
+		})
+	}
+}
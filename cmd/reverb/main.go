@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reverb server from Chapter 8 of "The Go Programming Language" (section 8.3): every line a client sends
+// comes back three times, loud, normal and quiet, like an echo in a canyon:
+//
+//	go run ./cmd/reverb -delay 1s -idle 10s
+//	go run ./cmd/netcat localhost:8002
+//
+// Every line echoes in its own goroutine, so a second shout overlaps the first one instead of waiting
+// for it (exercise 8.4 closes the write side only once they all finished, exercise 8.8 hangs up on
+// clients that stay quiet for too long).
+func main() {
+	addr := flag.String("addr", "localhost:8002", "Address to listen on")
+	delay := flag.Duration("delay", time.Second, "Time between one echo of a line and the next")
+	idle := flag.Duration("idle", 10*time.Second, "Disconnect clients that send nothing for this long")
+	writeTimeout := flag.Duration("write-timeout", 5*time.Second, "Longest time a single echo may take to write")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "How long to wait for the echoes in the air before closing the connections")
+	flag.Parse()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		slog.Error("Failed to start listener", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("Reverb server listening", "addr", listener.Addr().String(), "delay", *delay, "idle", *idle)
+
+	// Same shutdown as cmd/tour5, smaller: the signal cancels ctx, which closes the listener and wakes every reader up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, func() { listener.Close() })
+
+	srv := newServer(*delay, *idle, *writeTimeout)
+	srv.serve(ctx, listener)
+	slog.Info("Shutting down, waiting for the echoes still in the air")
+	if srv.drain(*shutdownTimeout) {
+		slog.Warn("Shutdown deadline exceeded, closed the remaining connections", "timeout", *shutdownTimeout)
+	}
+}
+
+// server holds the settings every connection is served with, and what shutting down needs.
+type server struct {
+	delay        time.Duration
+	idle         time.Duration
+	writeTimeout time.Duration
+
+	wg sync.WaitGroup // Running handlers
+
+	// Cancelled once the shutdown deadline has passed: connections still open get closed,
+	// and echoes waiting for their next turn give up
+	kill    context.Context
+	killAll context.CancelFunc
+}
+
+func newServer(delay, idle, writeTimeout time.Duration) *server {
+	kill, killAll := context.WithCancel(context.Background())
+	return &server{delay: delay, idle: idle, writeTimeout: writeTimeout, kill: kill, killAll: killAll}
+}
+
+// serve accepts connections until ctx is cancelled and the listener closed.
+func (s *server) serve(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Error accepting connection", "err", err)
+			continue
+		}
+		s.wg.Go(func() { s.handleConn(ctx, conn.(*net.TCPConn)) })
+	}
+}
+
+// drain waits for the handlers to finish, and reports whether it had to close connections
+// because they were still busy after timeout.
+func (s *server) drain(timeout time.Duration) (forced bool) {
+	deadline := time.AfterFunc(timeout, s.killAll)
+	s.wg.Wait()
+	return !deadline.Stop()
+}
+
+// handleConn echoes every line of conn until the client closes its side, stays quiet for idle, or ctx is cancelled.
+// Then it waits for the echoes still running and closes the write side, so the client gets all of them before EOF.
+func (s *server) handleConn(ctx context.Context, conn *net.TCPConn) {
+	defer conn.Close()
+	log := slog.With("remote", conn.RemoteAddr().String())
+	log.Info("Client connected")
+
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	stopKill := context.AfterFunc(s.kill, func() { conn.Close() })
+	defer stopKill()
+
+	var echoes sync.WaitGroup
+	input := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.idle)) // Pushed back by every line, so only silence runs it out
+		if ctx.Err() != nil {
+			break // Shutting down, and the idle deadline may have overwritten the one that ends the read
+		}
+		if !input.Scan() {
+			break
+		}
+		shout := input.Text()
+		echoes.Go(func() { s.echo(conn, shout) })
+	}
+
+	reason := "client closed its side"
+	switch err := input.Err(); {
+	case ctx.Err() != nil:
+		reason = "server shutting down"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		reason = fmt.Sprintf("idle for %v", s.idle)
+	case err != nil:
+		reason = err.Error()
+	}
+
+	// Closing the connection right away would cut the echoes short: waiting for them first, then a half-close
+	// tells the client nothing else is coming while its own side (if still open) could still be read.
+	// https://pkg.go.dev/net#TCPConn.CloseWrite
+	echoes.Wait()
+	if err := conn.CloseWrite(); err != nil {
+		log.Warn("Error closing the write side", "err", err)
+	}
+	log.Info("Client disconnected", "reason", reason)
+}
+
+// echo writes shout three times, each one fainter and delay after the previous one.
+func (s *server) echo(conn net.Conn, shout string) {
+	for i, line := range []string{strings.ToUpper(shout), shout, strings.ToLower(shout)} {
+		if i > 0 {
+			select {
+			case <-time.After(s.delay):
+			case <-s.kill.Done():
+				return // The connection was closed by the shutdown, nobody left to hear the rest
+			}
+		}
+		// Several echoes may write at once; a net.Conn is safe for that, and one Fprintln is one Write, so lines never mix.
+		// The deadline is shared by all of them, each one pushes it back before its own write.
+		conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		if _, err := fmt.Fprintln(conn, "\t"+line); err != nil {
+			return // Client gone or not reading, the rest of the echo has nobody to hear it
+		}
+	}
+}
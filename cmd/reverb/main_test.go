@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveOne runs handleConn on one loopback connection and returns the client side of it.
+// done is closed when handleConn returns.
+func serveOne(t *testing.T, ctx context.Context, delay, idle time.Duration) (client *net.TCPConn, done <-chan struct{}) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		newServer(delay, idle, 5*time.Second).handleConn(ctx, conn.(*net.TCPConn))
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		<-finished
+	})
+	conn.SetDeadline(time.Now().Add(10 * time.Second)) // Nothing below should take that long
+	return conn.(*net.TCPConn), finished
+}
+
+// readAll reads lines until the server closes its side.
+func readAll(t *testing.T, conn net.Conn) []string {
+	t.Helper()
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading until EOF: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestEchoOrder(t *testing.T) {
+	conn, _ := serveOne(t, context.Background(), 20*time.Millisecond, 5*time.Second)
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "Hello Canyon\n")
+	for _, want := range []string{"\tHELLO CANYON\n", "\tHello Canyon\n", "\thello canyon\n"} {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("echo = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestEchoesOverlap(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	conn, _ := serveOne(t, context.Background(), delay, 5*time.Second)
+
+	// The second shout does not wait for the first one to fade: both are loud before either is quiet
+	start := time.Now()
+	io.WriteString(conn, "One\nTwo\n")
+	conn.CloseWrite()
+	lines := readAll(t, conn)
+	if elapsed := time.Since(start); elapsed >= 4*delay {
+		t.Errorf("two shouts took %v, they ran one after the other", elapsed)
+	}
+
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines %q, want 6", len(lines), lines)
+	}
+	loud := map[string]bool{lines[0]: true, lines[1]: true}
+	if !loud["\tONE"] || !loud["\tTWO"] {
+		t.Errorf("first two lines = %q, want both loud echoes", lines[:2])
+	}
+	// Each shout on its own still goes loud, normal, quiet
+	for _, shout := range []string{"One", "Two"} {
+		var order []string
+		for _, line := range lines {
+			if strings.EqualFold(line, "\t"+shout) {
+				order = append(order, line)
+			}
+		}
+		want := []string{"\t" + strings.ToUpper(shout), "\t" + shout, "\t" + strings.ToLower(shout)}
+		if strings.Join(order, "|") != strings.Join(want, "|") {
+			t.Errorf("echoes of %q = %q, want %q", shout, order, want)
+		}
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	conn, done := serveOne(t, context.Background(), 20*time.Millisecond, 5*time.Second)
+
+	// Closing our write side right after the shout: the echoes must still all arrive, and then EOF
+	io.WriteString(conn, "bye\n")
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	lines := readAll(t, conn)
+	if want := []string{"\tBYE", "\tbye", "\tbye"}; strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("handleConn still running after EOF")
+	}
+}
+
+func TestIdle(t *testing.T) {
+	conn, done := serveOne(t, context.Background(), 20*time.Millisecond, 100*time.Millisecond)
+
+	io.WriteString(conn, "hi\n")
+	// Silent from here on: after the echoes the server hangs up, our own side still open
+	lines := readAll(t, conn)
+	if len(lines) != 3 {
+		t.Errorf("got %q, want the three echoes", lines)
+	}
+	<-done
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("while waiting for a line", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		conn, done := serveOne(t, ctx, 20*time.Millisecond, time.Hour)
+		io.WriteString(conn, "last words\n")
+		bufio.NewReader(conn).ReadString('\n') // The loud echo: the line was read, handleConn is waiting for the next one
+		cancel()
+
+		// The echo in the air still finishes before the server hangs up
+		lines := readAll(t, conn)
+		if want := []string{"\tlast words", "\tlast words"}; strings.Join(lines, "|") != strings.Join(want, "|") {
+			t.Errorf("got %q after the loud echo, want %q", lines, want)
+		}
+		<-done
+	})
+
+	t.Run("before the first read", func(t *testing.T) {
+		// Cancelled before handleConn starts: its AfterFunc runs right away, racing with the idle deadline the loop sets.
+		// Whichever of the two goes first, the connection must not wait an hour for a line. The goroutine scheduling
+		// cannot be forced from here, so this only catches the race when the AfterFunc happens to win it.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		conn, done := serveOne(t, ctx, 20*time.Millisecond, time.Hour)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handleConn still waiting for a line after the shutdown")
+		}
+		if lines := readAll(t, conn); len(lines) != 1 || lines[0] != "" {
+			t.Errorf("got %q, want nothing before EOF", lines)
+		}
+	})
+}
+
+// TestShutdownClientNotReading shouts far more than the socket buffers hold and never reads the echoes,
+// so writes block. The shutdown must still end: through the write deadline, or by closing the connection.
+func TestShutdownClientNotReading(t *testing.T) {
+	tests := []struct {
+		name         string
+		writeTimeout time.Duration
+		forced       bool
+	}{
+		{name: "write deadline", writeTimeout: 100 * time.Millisecond},
+		{name: "shutdown deadline", writeTimeout: time.Hour, forced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := newServer(time.Millisecond, time.Hour, tt.writeTimeout)
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan struct{})
+			go func() {
+				srv.serve(ctx, listener)
+				close(served)
+			}()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			shout := strings.Repeat("a", 1000) + "\n"
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.WriteString(conn, strings.Repeat(shout, 5000)); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(200 * time.Millisecond) // Lets the echoes fill the buffers and block
+
+			cancel()
+			listener.Close()
+			<-served
+			start := time.Now()
+			if forced := srv.drain(500 * time.Millisecond); forced != tt.forced {
+				t.Errorf("forced = %v, want %v", forced, tt.forced)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("shutdown took %v", elapsed)
+			}
+		})
+	}
+}
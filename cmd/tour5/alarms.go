@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Timing commands, for using the clock stream as a shared timer (stand-ups, pomodoros...):
+//
+//	ALARM <15:04[:05]> [label]  notifies at the next time the clock shows that time (in the connection's time zone)
+//	TIMER <duration> [label]    notifies once the duration (e.g. "5m", "1h30m") has passed
+//	LIST                        lists what is pending, soonest first
+//	CANCEL <id>                 drops a pending alarm or timer
+//	STOPWATCH start|lap|stop    measures time on the server, no notification involved
+//
+// Everything belongs to the connection: nothing is shared with other clients, and whatever is pending is dropped when it closes.
+// Notifications are sent even while PAUSEd, since pausing is about the ticks.
+
+// Alarms and timers a single connection can have pending, so a client cannot make the server hold on to unlimited memory
+const maxPending = 16
+
+// Longest TIMER accepted; for anything further away ALARM is the better fit
+const maxTimer = 24 * time.Hour
+
+// reminder is a pending alarm or timer.
+type reminder struct {
+	id    int
+	kind  string // "ALARM" or "TIMER"
+	what  string // "15:30" or "5m0s", as shown in notifications
+	label string
+	due   time.Time
+}
+
+// notification is the line sent when r goes off.
+func (r reminder) notification() string {
+	return strings.TrimRight(fmt.Sprintf("%s #%d %s %s", r.kind, r.id, r.what, r.label), " ") + "\n"
+}
+
+// stopwatch is the state of the STOPWATCH command.
+type stopwatch struct {
+	running bool
+	started time.Time
+	lastLap time.Time
+	laps    int
+}
+
+// addReminder stores r with a fresh id, keeping the list sorted by due time.
+func (s *session) addReminder(r reminder) (reminder, error) {
+	if len(s.reminders) >= maxPending {
+		return r, fmt.Errorf("too many alarms and timers pending (max %d), CANCEL one first", maxPending)
+	}
+	s.lastID++
+	r.id = s.lastID
+	i, _ := slices.BinarySearchFunc(s.reminders, r.due, func(p reminder, due time.Time) int { return p.due.Compare(due) })
+	s.reminders = slices.Insert(s.reminders, i, r)
+	return r, nil
+}
+
+// nextDue is when the soonest reminder goes off; ok is false when nothing is pending.
+func (s *session) nextDue() (due time.Time, ok bool) {
+	if len(s.reminders) == 0 {
+		return time.Time{}, false
+	}
+	return s.reminders[0].due, true
+}
+
+// due removes the reminders that went off by now and returns their notification lines.
+func (s *session) due(now time.Time) []string {
+	var lines []string
+	for len(s.reminders) > 0 && !s.reminders[0].due.After(now) {
+		lines = append(lines, s.reminders[0].notification())
+		s.reminders = s.reminders[1:]
+	}
+	return lines
+}
+
+func (s *session) alarm(arg string, now time.Time) string {
+	at, label, _ := strings.Cut(arg, " ")
+	when, err := parseTimeOfDay(at)
+	if err != nil {
+		return "ERR ALARM needs a time of day, e.g. ALARM 15:30 or ALARM 09:15:30 standup\n"
+	}
+	due := nextTimeOfDay(now, when, s.location)
+
+	r, err := s.addReminder(reminder{kind: "ALARM", what: at, label: strings.TrimSpace(label), due: due})
+	if err != nil {
+		return fmt.Sprintf("ERR %v\n", err)
+	}
+	return fmt.Sprintf("OK ALARM #%d at %s (in %v)\n", r.id, due.Format(time.RFC3339), due.Sub(now).Round(time.Second))
+}
+
+// parseTimeOfDay reads "15:04" or "15:04:05". Only the clock fields of the result mean anything.
+func parseTimeOfDay(value string) (time.Time, error) {
+	if t, err := time.Parse("15:04", value); err == nil {
+		return t, nil
+	}
+	return time.Parse("15:04:05", value)
+}
+
+// nextTimeOfDay is the first time after now that the clock shows the time of day of when, in loc:
+// today if that time is still ahead, otherwise tomorrow. time.Date normalizes day+1 across month ends,
+// and going through the calendar (instead of adding 24h) keeps the time of day right across DST changes.
+func nextTimeOfDay(now, when time.Time, loc *time.Location) time.Time {
+	local := now.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day(), when.Hour(), when.Minute(), when.Second(), 0, loc)
+	if !next.After(now) {
+		next = time.Date(local.Year(), local.Month(), local.Day()+1, when.Hour(), when.Minute(), when.Second(), 0, loc)
+	}
+	return next
+}
+
+func (s *session) timer(arg string, now time.Time) string {
+	length, label, _ := strings.Cut(arg, " ")
+	d, err := time.ParseDuration(length)
+	if err != nil || d <= 0 {
+		return "ERR TIMER needs a positive duration, e.g. TIMER 5m or TIMER 90s tea\n"
+	}
+	if d > maxTimer {
+		return fmt.Sprintf("ERR TIMER is limited to %v, use ALARM instead\n", maxTimer)
+	}
+
+	// now came from the server clock with its monotonic reading, so the timer is immune to wall clock changes.
+	// https://pkg.go.dev/time#hdr-Monotonic_Clocks
+	r, err := s.addReminder(reminder{kind: "TIMER", what: d.String(), label: strings.TrimSpace(label), due: now.Add(d)})
+	if err != nil {
+		return fmt.Sprintf("ERR %v\n", err)
+	}
+	return fmt.Sprintf("OK TIMER #%d %v\n", r.id, d)
+}
+
+// list answers LIST in a single line, like every other reply, e.g. "OK LIST 2 #1 ALARM 15:30 in 12m3s; #2 TIMER 5m0s tea in 4m10s".
+func (s *session) list(now time.Time) string {
+	if len(s.reminders) == 0 {
+		return "OK LIST 0\n"
+	}
+	entries := make([]string, len(s.reminders))
+	for i, r := range s.reminders {
+		entries[i] = strings.TrimRight(fmt.Sprintf("#%d %s %s %s", r.id, r.kind, r.what, r.label), " ") +
+			fmt.Sprintf(" in %v", max(r.due.Sub(now), 0).Round(time.Second))
+	}
+	return fmt.Sprintf("OK LIST %d %s\n", len(entries), strings.Join(entries, "; "))
+}
+
+func (s *session) cancel(arg string) string {
+	var id int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(arg, "#"), "%d", &id); err != nil {
+		return "ERR CANCEL needs the id shown by LIST, e.g. CANCEL 2\n"
+	}
+	i := slices.IndexFunc(s.reminders, func(r reminder) bool { return r.id == id })
+	if i < 0 {
+		return fmt.Sprintf("ERR nothing pending with id %d\n", id)
+	}
+	r := s.reminders[i]
+	s.reminders = slices.Delete(s.reminders, i, i+1)
+	return fmt.Sprintf("OK CANCEL #%d %s %s\n", r.id, r.kind, r.what)
+}
+
+func (s *session) stopwatch(arg string, now time.Time) string {
+	sw := &s.watch
+	switch strings.ToLower(arg) {
+	case "start":
+		*sw = stopwatch{running: true, started: now, lastLap: now}
+		return "OK STOPWATCH started\n"
+
+	case "lap":
+		if !sw.running {
+			return "ERR STOPWATCH is not running, STOPWATCH start first\n"
+		}
+		sw.laps++
+		lap := now.Sub(sw.lastLap)
+		sw.lastLap = now
+		return fmt.Sprintf("OK STOPWATCH lap %d %v (total %v)\n", sw.laps, round(lap), round(now.Sub(sw.started)))
+
+	case "stop":
+		if !sw.running {
+			return "ERR STOPWATCH is not running\n"
+		}
+		sw.running = false
+		return fmt.Sprintf("OK STOPWATCH stopped %v (%d laps)\n", round(now.Sub(sw.started)), sw.laps)
+
+	default:
+		return "ERR STOPWATCH needs start, lap or stop\n"
+	}
+}
+
+// round keeps stopwatch readings to milliseconds, more digits than that would only be network noise.
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNextTimeOfDay(t *testing.T) {
+	utc := func(month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(2026, month, day, hour, min, sec, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		loc  string
+		now  time.Time
+		when string // As typed after ALARM
+		want time.Time
+	}{
+		{name: "later today", loc: "UTC", now: utc(time.October, 18, 12, 0, 0), when: "15:30", want: utc(time.October, 18, 15, 30, 0)},
+		{name: "a second ahead", loc: "UTC", now: utc(time.October, 18, 12, 0, 0), when: "12:00:01", want: utc(time.October, 18, 12, 0, 1)},
+		{name: "already passed today", loc: "UTC", now: utc(time.October, 18, 12, 0, 0), when: "09:00", want: utc(time.October, 19, 9, 0, 0)},
+		{name: "right now", loc: "UTC", now: utc(time.October, 18, 12, 0, 0), when: "12:00", want: utc(time.October, 19, 12, 0, 0)},
+		{name: "midnight", loc: "UTC", now: utc(time.October, 18, 23, 59, 30), when: "00:00", want: utc(time.October, 19, 0, 0, 0)},
+		{name: "month end", loc: "UTC", now: utc(time.October, 31, 20, 0, 0), when: "08:00", want: utc(time.November, 1, 8, 0, 0)},
+		{name: "year end", loc: "UTC", now: utc(time.December, 31, 23, 0, 0), when: "07:00", want: time.Date(2027, time.January, 1, 7, 0, 0, 0, time.UTC)},
+		// 16:00 UTC is already 01:00 on the 19th in Tokyo, so the next 08:00 there is 7 hours away
+		{name: "another day in the time zone", loc: "Asia/Tokyo", now: utc(time.October, 18, 16, 0, 0), when: "08:00", want: utc(time.October, 18, 23, 0, 0)},
+		// Paris goes back to UTC+1 on October 25: 09:00 the next morning is 22 hours after noon, not 21
+		{name: "DST ending", loc: "Europe/Paris", now: utc(time.October, 24, 10, 0, 0), when: "09:00", want: utc(time.October, 25, 8, 0, 0)},
+		// And forward to UTC+2 on March 29: 20 hours after noon
+		{name: "DST starting", loc: "Europe/Paris", now: utc(time.March, 28, 11, 0, 0), when: "09:00", want: utc(time.March, 29, 7, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			when, err := parseTimeOfDay(tt.when)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := nextTimeOfDay(tt.now, when, loc); !got.Equal(tt.want) {
+				t.Errorf("next %s after %v = %v, want %v", tt.when, tt.now.In(loc), got, tt.want.In(loc))
+			}
+		})
+	}
+}
+
+func TestStopwatch(t *testing.T) {
+	sess := testSession(t)
+	start := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after time.Duration // Since start
+		line  string
+		reply string
+	}{
+		{after: 0, line: "STOPWATCH start", reply: "OK STOPWATCH started\n"},
+		{after: 1500 * time.Millisecond, line: "STOPWATCH lap", reply: "OK STOPWATCH lap 1 1.5s (total 1.5s)\n"},
+		{after: 4 * time.Second, line: "STOPWATCH lap", reply: "OK STOPWATCH lap 2 2.5s (total 4s)\n"},
+		{after: 5*time.Second + 400*time.Microsecond, line: "STOPWATCH stop", reply: "OK STOPWATCH stopped 5s (2 laps)\n"}, // Rounded to the millisecond
+		{after: time.Minute, line: "STOPWATCH start", reply: "OK STOPWATCH started\n"},                                     // Starting again starts from zero
+		{after: time.Minute + time.Second, line: "STOPWATCH lap", reply: "OK STOPWATCH lap 1 1s (total 1s)\n"},
+	}
+	for _, step := range steps {
+		if reply, _ := sess.handle(step.line, start.Add(step.after)); reply != step.reply {
+			t.Errorf("%s after %v = %q, want %q", step.line, step.after, reply, step.reply)
+		}
+	}
+}
+
+// TestHarnessReminders runs alarms and timers through handleConn on the fake clock. Ticks are an hour apart,
+// so every line read below is a reply or a notification.
+func TestHarnessReminders(t *testing.T) {
+	t.Run("notified when due", func(t *testing.T) {
+		h := startHarness(t, "-interval", "1h")
+		conn := h.listener.dial(t)
+		r := bufio.NewReader(conn)
+		readLine(t, r, conn) // Tick on connecting
+
+		io.WriteString(conn, "TIMER 5m tea\nALARM 12:10 standup\n")
+		for _, want := range []string{"OK TIMER #1 5m0s\n", "OK ALARM #2 at 2026-10-18T12:10:00Z (in 10m0s)\n"} {
+			if got := readLine(t, r, conn); got != want {
+				t.Fatalf("reply = %q, want %q", got, want)
+			}
+		}
+		h.clock.waitArmed(t, 2) // The broadcaster and the connection's reminder timer
+
+		// A second early, nothing: the reply to LIST is the next line
+		h.clock.Advance(5*time.Minute - time.Second)
+		io.WriteString(conn, "LIST\n")
+		if got, want := readLine(t, r, conn), "OK LIST 2 #1 TIMER 5m0s tea in 1s; #2 ALARM 12:10 standup in 5m1s\n"; got != want {
+			t.Fatalf("LIST = %q, want %q", got, want)
+		}
+
+		h.clock.Advance(time.Second)
+		if got, want := readLine(t, r, conn), "TIMER #1 5m0s tea\n"; got != want {
+			t.Errorf("notification = %q, want %q", got, want)
+		}
+		h.clock.waitArmed(t, 2) // Re-armed for the alarm
+		h.clock.Advance(5 * time.Minute)
+		if got, want := readLine(t, r, conn), "ALARM #2 12:10 standup\n"; got != want {
+			t.Errorf("notification = %q, want %q", got, want)
+		}
+
+		io.WriteString(conn, "LIST\n")
+		if got := readLine(t, r, conn); got != "OK LIST 0\n" {
+			t.Errorf("LIST after both went off = %q, want nothing pending", got)
+		}
+	})
+
+	t.Run("dropped on disconnect", func(t *testing.T) {
+		h := startHarness(t)
+		conn := h.listener.dial(t)
+		r := bufio.NewReader(conn)
+		readLine(t, r, conn)
+
+		io.WriteString(conn, "TIMER 5m\n")
+		if got := readLine(t, r, conn); got != "OK TIMER #1 5m0s\n" {
+			t.Fatalf("reply = %q", got)
+		}
+		h.clock.waitArmed(t, 2)
+		conn.Close()
+
+		// The next tick finds the client gone; the handler stops its reminder timer on the way out
+		h.tick(t)
+		h.waitDisconnect(t, reasonClientGone)
+		h.clock.waitArmed(t, 1) // The broadcaster, once it re-armed after the tick
+		if n := h.clock.armed(); n != 1 {
+			t.Errorf("%d timers armed after the client left, want only the broadcaster's", n)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// A single broadcaster goroutine owns the only ticker of the server and the set of subscribers,
+// just like the broadcaster of the chat server in Chapter 8 of "The Go Programming Language".
+// Every tick is formatted once and handed to each connection, so N clients no longer mean N timers
+// and every client sees the second change at the same moment.
+
+// tick is one instant shared by every connection.
+type tick struct {
+	time time.Time
+	line string // Already formatted with the server's default format and time zone, newline included
+}
+
+// subscriber is the receiving end of one connection.
+type subscriber struct {
+	// Buffered with room for a single tick. The broadcaster never waits for a slow subscriber:
+	// if the previous tick was not picked up yet, it gets replaced by the newer one.
+	ticks  chan tick
+	missed atomic.Int64 // Ticks replaced before the subscriber got to them
+}
+
+type broadcaster struct {
+	clock   clock
+	cfg     atomic.Pointer[config] // Swapped by setConfig when the configuration is reloaded
+	changed chan struct{}          // Wakes run up after setConfig, so a new interval takes effect right away
+
+	// Only the goroutine running "run" touches the subscribers map, everybody else talks to it through these channels.
+	// Sharing memory by communicating: https://go.dev/blog/codelab-share
+	entering chan *subscriber
+	leaving  chan *subscriber
+	done     chan struct{} // Closed when run returns, so nobody blocks on entering/leaving afterwards
+}
+
+func newBroadcaster(cfg *config, clk clock) *broadcaster {
+	b := &broadcaster{
+		clock:    clk,
+		changed:  make(chan struct{}, 1),
+		entering: make(chan *subscriber),
+		leaving:  make(chan *subscriber),
+		done:     make(chan struct{}),
+	}
+	b.cfg.Store(cfg)
+	return b
+}
+
+// now is the current tick, as sent to a client when it connects.
+func (b *broadcaster) now() tick {
+	return b.newTick(b.clock.Now())
+}
+
+// newTick formats t with the server defaults.
+func (b *broadcaster) newTick(t time.Time) tick {
+	cfg := b.cfg.Load()
+	return tick{time: t, line: cfg.format.format(t.In(cfg.location)) + "\n"}
+}
+
+// setConfig makes the next ticks use the format, time zone and interval of cfg.
+func (b *broadcaster) setConfig(cfg *config) {
+	b.cfg.Store(cfg)
+	select {
+	case b.changed <- struct{}{}:
+	default: // A wake-up is already pending, run will load the latest config anyway
+	}
+}
+
+// Aligned mode (-align) fires this long after each boundary, so "now" is safely past it when the line is formatted
+const alignSlack = time.Millisecond
+
+// run is the broadcaster goroutine, it stops when ctx is cancelled.
+func (b *broadcaster) run(ctx context.Context) {
+	defer close(b.done)
+
+	subscribers := make(map[*subscriber]struct{})
+	sched := b.newSchedule()
+	defer sched.stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case sub := <-b.entering:
+			subscribers[sub] = struct{}{}
+
+		case sub := <-b.leaving:
+			delete(subscribers, sub)
+
+		case <-b.changed:
+			// Interval or alignment may have changed, starting over from now
+			sched.stop()
+			sched = b.newSchedule()
+
+		case <-sched.timer.C():
+			now, ok := sched.fired(b.clock.Now())
+			sched = b.nextSchedule(sched, now)
+			if !ok {
+				continue
+			}
+			t := b.newTick(now)
+			for sub := range subscribers {
+				publish(sub, t)
+			}
+		}
+	}
+}
+
+// schedule is the tick the broadcaster is waiting for.
+//
+// Without -align, ticks come every interval from when the server started, like a time.Ticker: "next" keeps
+// the monotonic clock reading of time.Now, so changes to the system clock do not affect the pace at all.
+// https://pkg.go.dev/time#hdr-Monotonic_Clocks
+//
+// With -align, ticks fire just after each multiple of the period on the wall clock (every second at .001,
+// every minute at :00.001, and so on), so every client sees the second change at the same moment, which is also
+// the moment it changes on the server's clock. Timers still run on the monotonic clock, so a jump of the
+// wall clock while waiting shows up as a timer firing at the wrong wall time: fired spots that and resyncs.
+type schedule struct {
+	timer  timer
+	next   time.Time     // When the timer should fire
+	period time.Duration // Alignment period, 0 when not aligned
+}
+
+func (b *broadcaster) newSchedule() schedule {
+	cfg := b.cfg.Load()
+	now := b.clock.Now()
+	if cfg.align > 0 {
+		return b.alignedSchedule(now, cfg.align)
+	}
+	return schedule{timer: b.clock.NewTimer(cfg.interval), next: now.Add(cfg.interval)}
+}
+
+// nextSchedule is the one after sched fired, now being the time it fired at.
+func (b *broadcaster) nextSchedule(sched schedule, now time.Time) schedule {
+	if sched.period > 0 {
+		return b.alignedSchedule(now, sched.period)
+	}
+	interval := b.cfg.Load().interval
+	next := sched.next.Add(interval)
+	if next.Before(now) {
+		next = now.Add(interval) // Fell more than a whole interval behind: skipping, as a time.Ticker would
+	}
+	return schedule{timer: b.clock.NewTimer(next.Sub(now)), next: next}
+}
+
+// alignedSchedule waits for the first multiple of period after now.
+// Truncate counts from the zero time in UTC, so periods that divide a day (5s, 15m, 1h) line up with the clock face.
+// https://pkg.go.dev/time#Time.Truncate
+func (b *broadcaster) alignedSchedule(now time.Time, period time.Duration) schedule {
+	next := now.Truncate(period).Add(period) // Truncate also drops the monotonic reading: "next" is a wall clock time
+	return schedule{timer: b.clock.NewTimer(next.Sub(now) + alignSlack), next: next, period: period}
+}
+
+// fired checks the time the timer fired at, and reports whether a tick should go out.
+func (sched schedule) fired(now time.Time) (time.Time, bool) {
+	if sched.period == 0 {
+		return now, true
+	}
+	switch late := now.Sub(sched.next); {
+	case late < 0:
+		// Before the boundary, although the timer waited long enough: the wall clock was moved back.
+		// Sending now would repeat a second clients already saw, so waiting for the next boundary of the new time instead.
+		slog.Warn("System clock jumped backwards, resyncing aligned ticks", "jump", -late, "now", now)
+		return now, false
+	case late > sched.period:
+		// Far past the boundary: the wall clock was moved forward (or the machine was suspended). Sending the current time;
+		// the seconds in between are skipped because they never happened on this clock.
+		slog.Warn("System clock jumped forward, resyncing aligned ticks", "jump", late, "now", now)
+		return now, true
+	default:
+		return now, true
+	}
+}
+
+func (sched schedule) stop() {
+	sched.timer.Stop()
+}
+
+// publish hands t to sub without ever blocking.
+func publish(sub *subscriber, t tick) {
+	select {
+	case sub.ticks <- t:
+	default:
+		// The buffer still holds an older tick: throwing it away and putting the fresh one in its place.
+		// Only the broadcaster sends on this channel, so after the receive there is room for the send.
+		select {
+		case <-sub.ticks:
+		default:
+		}
+		select {
+		case sub.ticks <- t:
+		default:
+		}
+		sub.missed.Add(1)
+	}
+}
+
+// subscribe registers a new subscriber. It returns nil if the broadcaster already stopped.
+func (b *broadcaster) subscribe() *subscriber {
+	sub := &subscriber{ticks: make(chan tick, 1)}
+	select {
+	case b.entering <- sub:
+		return sub
+	case <-b.done:
+		return nil
+	}
+}
+
+func (b *broadcaster) unsubscribe(sub *subscriber) {
+	select {
+	case b.leaving <- sub:
+	case <-b.done:
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The two benchmarks below compare the design before the broadcaster (one time.Ticker per connection, every
+// connection formatting its own line) with the shared broadcaster, on real loopback connections. One operation is
+// as many tick lines received as there are connections, one round of ticks. The interval is short enough for a round
+// to take longer than it, so both designs run flat out and what is measured is the cost of a round, not the interval.
+//
+//	go test -run '^$' -bench 'PerConnTicker|Broadcaster' -benchmem ./cmd/tour5
+const (
+	benchConns    = 10000
+	benchInterval = 10 * time.Millisecond
+)
+
+func BenchmarkPerConnTicker(b *testing.B) {
+	format, _ := parseFormat("clock")
+	benchmarkTicks(b, func(ctx context.Context, conn net.Conn) {
+		perConnTicker(ctx, conn, benchInterval, format)
+	})
+}
+
+func BenchmarkBroadcaster(b *testing.B) {
+	format, _ := parseFormat("clock")
+	cfg := config{interval: benchInterval, format: format, location: time.Local}
+	ticks := newBroadcaster(&cfg, systemClock{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ticks.run(ctx)
+
+	benchmarkTicks(b, func(ctx context.Context, conn net.Conn) {
+		sub := ticks.subscribe()
+		if sub == nil {
+			return
+		}
+		defer ticks.unsubscribe(sub)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t := <-sub.ticks:
+				if _, err := io.WriteString(conn, t.line); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+// perConnTicker is how handleConn sent ticks before the broadcaster: a ticker of its own, and its own formatting.
+// Kept here only to compare against.
+func perConnTicker(ctx context.Context, conn net.Conn, interval time.Duration, format timeFormat) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			if _, err := io.WriteString(conn, format.format(t.In(time.Local))+"\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// benchmarkTicks opens the loopback connections, runs handle on the server side of each one and counts
+// the lines arriving on the client side until b.N rounds (conns lines each) arrived.
+func benchmarkTicks(b *testing.B, handle func(ctx context.Context, conn net.Conn)) {
+	conns := benchConnCount(b)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Handlers only start once every connection is open: ticking while the others are still dialing would starve the dialer
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	var accepted atomic.Int64
+	var handlers sync.WaitGroup
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			handlers.Go(func() {
+				defer conn.Close()
+				select {
+				case <-ready:
+					handle(ctx, conn)
+				case <-ctx.Done():
+				}
+			})
+		}
+	}()
+
+	var lines atomic.Int64
+	var readers sync.WaitGroup
+	clients := make([]net.Conn, 0, conns)
+	for range conns {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			b.Fatalf("dial %d: %v", len(clients), err)
+		}
+		clients = append(clients, conn)
+		readers.Go(func() {
+			r := bufio.NewReader(conn)
+			for {
+				if _, err := r.ReadSlice('\n'); err != nil {
+					return
+				}
+				lines.Add(1)
+			}
+		})
+	}
+	defer func() {
+		cancel()
+		listener.Close()
+		for _, conn := range clients {
+			conn.Close()
+		}
+		readers.Wait()
+		handlers.Wait()
+	}()
+
+	for accepted.Load() < int64(conns) {
+		time.Sleep(time.Millisecond)
+	}
+	close(ready)
+
+	// Every connection has to be receiving before measuring
+	for lines.Load() < int64(conns) {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	target := lines.Load() + int64(conns)*int64(b.N)
+	for lines.Load() < target {
+		time.Sleep(100 * time.Microsecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(conns), "conns")
+}
+
+// benchConnCount is benchConns, or fewer when the file descriptor limit cannot hold both ends of that many connections.
+func benchConnCount(b *testing.B) int {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return benchConns
+	}
+	if limit.Cur < limit.Max {
+		limit.Cur = limit.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit) // Best effort, the count below uses whatever is in effect
+		syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit)
+	}
+	available := int(limit.Cur/2) - 100 // Both ends live in this process, plus some room for everything else
+	if available < benchConns {
+		b.Logf("file descriptor limit %d only allows %d connections instead of %d", limit.Cur, available, benchConns)
+		return available
+	}
+	return benchConns
+}
+
+func TestAlignedSchedule(t *testing.T) {
+	day := time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		now    time.Duration // Since midnight
+		period time.Duration
+		next   time.Duration
+	}{
+		{name: "within a second", now: 12*time.Hour + 300*time.Millisecond, period: time.Second, next: 12*time.Hour + time.Second},
+		{name: "on a boundary", now: 12 * time.Hour, period: time.Second, next: 12*time.Hour + time.Second},
+		{name: "just before a boundary", now: 12*time.Hour + 999*time.Millisecond, period: time.Second, next: 12*time.Hour + time.Second},
+		{name: "five seconds", now: 12*time.Hour + 3*time.Second, period: 5 * time.Second, next: 12*time.Hour + 5*time.Second},
+		{name: "a minute", now: 12*time.Hour + 59*time.Second, period: time.Minute, next: 12*time.Hour + time.Minute},
+		{name: "quarter hour", now: 12*time.Hour + 16*time.Minute, period: 15 * time.Minute, next: 12*time.Hour + 30*time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := day.Add(tt.now)
+			clk := newFakeClock(now)
+			b := newBroadcaster(&config{}, clk)
+			sched := b.alignedSchedule(now, tt.period)
+			if want := day.Add(tt.next); !sched.next.Equal(want) || sched.period != tt.period {
+				t.Fatalf("next = %v, period %v; want %v, period %v", sched.next, sched.period, want, tt.period)
+			}
+
+			// The timer fires alignSlack after the boundary, not before
+			wait := sched.next.Sub(now) + alignSlack
+			clk.Advance(wait - time.Nanosecond)
+			select {
+			case at := <-sched.timer.C():
+				t.Fatalf("timer fired at %v, before the boundary plus slack", at)
+			default:
+			}
+			clk.Advance(time.Nanosecond)
+			select {
+			case at := <-sched.timer.C():
+				if want := sched.next.Add(alignSlack); !at.Equal(want) {
+					t.Errorf("timer fired at %v, want %v", at, want)
+				}
+			default:
+				t.Fatalf("timer did not fire %v after %v", wait, now)
+			}
+		})
+	}
+}
+
+func TestScheduleFired(t *testing.T) {
+	next := time.Date(2026, time.October, 18, 12, 0, 1, 0, time.UTC)
+	tests := []struct {
+		name   string
+		period time.Duration
+		now    time.Time // When the timer fired, on the wall clock
+		send   bool
+	}{
+		{name: "not aligned", now: next.Add(-time.Hour), send: true}, // Jumps are none of its business
+		{name: "on time", period: time.Second, now: next.Add(alignSlack), send: true},
+		{name: "late within the period", period: time.Second, now: next.Add(900 * time.Millisecond), send: true},
+		{name: "exactly a period late", period: time.Second, now: next.Add(time.Second), send: true},
+		{name: "wall clock moved back", period: time.Second, now: next.Add(-time.Hour)},
+		{name: "wall clock moved back a little", period: time.Second, now: next.Add(-time.Millisecond)},
+		{name: "wall clock moved forward", period: time.Second, now: next.Add(time.Hour), send: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched := schedule{next: next, period: tt.period}
+			at, send := sched.fired(tt.now)
+			if send != tt.send || !at.Equal(tt.now) {
+				t.Errorf("fired(%v) = %v, %v; want %v, %v", tt.now, at, send, tt.now, tt.send)
+			}
+		})
+	}
+}
+
+// TestBroadcasterClockJumps runs an aligned broadcaster on a fake clock and moves the wall clock under it.
+func TestBroadcasterClockJumps(t *testing.T) {
+	start := time.Date(2026, time.October, 18, 12, 0, 0, 300*int(time.Millisecond), time.UTC)
+	clk := newFakeClock(start)
+	format, _ := parseFormat("clock")
+	cfg := config{interval: time.Second, align: time.Second, format: format, location: time.UTC}
+	b := newBroadcaster(&cfg, clk)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.run(ctx)
+	sub := b.subscribe()
+	defer b.unsubscribe(sub)
+
+	// step lets d pass (after an optional jump of the wall clock) and returns the tick sent, if any.
+	// A new timer armed means run took the one that fired; it publishes right after arming it, so a subscribe
+	// round trip (run only takes it between two cases) makes sure it is done before looking.
+	step := func(jump, d time.Duration) (string, bool) {
+		t.Helper()
+		clk.waitArmed(t, 1)
+		clk.Jump(jump)
+		clk.Advance(d)
+		clk.waitArmed(t, 1)
+		b.unsubscribe(b.subscribe())
+		select {
+		case tk := <-sub.ticks:
+			return strings.TrimSpace(tk.line), true
+		default:
+			return "", false
+		}
+	}
+	expect := func(what string, jump, d time.Duration, want string) {
+		t.Helper()
+		got, ok := step(jump, d)
+		switch {
+		case want == "" && ok:
+			t.Errorf("%s: tick %q sent, want none", what, got)
+		case want != "" && got != want:
+			t.Errorf("%s: tick = %q (sent: %v), want %q", what, got, ok, want)
+		}
+	}
+
+	// First boundary 700ms away, then one every second, each a little after the second changes
+	expect("first boundary", 0, 700*time.Millisecond+alignSlack, "12:00:01")
+	expect("next boundary", 0, time.Second, "12:00:02")
+
+	// Set back an hour while waiting: the timer still fires a second later, at 11:00:03 on the wall clock.
+	// Sending that would repeat a second clients already saw an hour ago, so nothing goes out; the next boundary
+	// of the new time is the one after
+	expect("after moving back", -time.Hour, time.Second, "")
+	expect("resynced", 0, time.Second, "11:00:04")
+	expect("still in sync", 0, time.Second, "11:00:05")
+
+	// Set forward an hour: the time it is now goes out right away, the skipped seconds never happened here
+	expect("after moving forward", time.Hour, time.Second, "12:00:06")
+	expect("in sync again", 0, time.Second, "12:00:07")
+}
@@ -0,0 +1,28 @@
+package main
+
+import "time"
+
+// clock is where the server reads the time and gets its timers from. The broadcaster only talks to this interface,
+// so a fake clock that is moved by hand can stand in for the real one: ticks, alignment and clock jumps can then be
+// exercised without waiting for real seconds or touching the system clock.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+}
+
+// timer is the part of *time.Timer the broadcaster uses. Its channel is behind a method, since interfaces cannot have fields.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// systemClock is the real clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) timer { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock moved by hand. Like the real one it has two sides: the wall clock (Now) and the time
+// timers count, which only moves forward. Advance moves both, as time passing does; Jump only moves the wall clock,
+// as setting the system clock does, so timers fire when they are due and not at the wall time they were aimed at.
+type fakeClock struct {
+	mu      sync.Mutex
+	wall    time.Time
+	elapsed time.Duration // Monotonic time since the clock was created, what timers are due against
+	timers  []*fakeTimer  // Armed, in no particular order
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	due   time.Duration
+	c     chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{wall: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wall
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, due: c.elapsed + d, c: make(chan time.Time, 1)} // Buffered like time.Timer's, firing never blocks
+	if d <= 0 {
+		t.c <- c.wall
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance lets d pass, firing every timer due by then. Timers due in between fire in order, each one seeing
+// the wall time it was due at, as if the goroutine waiting for it had woken up right away.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.elapsed + d
+	for {
+		i := -1 // The soonest timer due by end
+		for j, t := range c.timers {
+			if t.due <= end && (i < 0 || t.due < c.timers[i].due) {
+				i = j
+			}
+		}
+		if i < 0 {
+			break
+		}
+		t := c.timers[i]
+		c.timers = slices.Delete(c.timers, i, i+1)
+		c.wall = c.wall.Add(t.due - c.elapsed)
+		c.elapsed = t.due
+		t.c <- c.wall
+	}
+	c.wall = c.wall.Add(end - c.elapsed)
+	c.elapsed = end
+}
+
+// Jump sets the wall clock d forward (or backwards, when negative) without any time passing.
+func (c *fakeClock) Jump(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wall = c.wall.Add(d)
+}
+
+// armed is how many timers are waiting to fire.
+func (c *fakeClock) armed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// waitArmed waits until n timers are waiting, which is how a test knows another goroutine got to its timer
+// before advancing the clock past it.
+func (c *fakeClock) waitArmed(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.armed() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers armed after 5s, want %d", c.armed(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := slices.Index(c.timers, t)
+	if i < 0 {
+		return false // Already fired or stopped
+	}
+	c.timers = slices.Delete(c.timers, i, i+1)
+	return true
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	clk := newFakeClock(start)
+	fired := func(tm timer) (time.Time, bool) {
+		select {
+		case at := <-tm.C():
+			return at, true
+		default:
+			return time.Time{}, false
+		}
+	}
+
+	late := clk.NewTimer(3 * time.Second)
+	soon := clk.NewTimer(time.Second)
+	stopped := clk.NewTimer(2 * time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop of an armed timer = false, want true")
+	}
+
+	clk.Advance(999 * time.Millisecond)
+	if _, ok := fired(soon); ok {
+		t.Fatal("timer fired before it was due")
+	}
+	clk.Advance(5 * time.Second)
+	if at, ok := fired(soon); !ok || !at.Equal(start.Add(time.Second)) {
+		t.Errorf("1s timer fired = %v at %v, want at %v", ok, at, start.Add(time.Second))
+	}
+	if at, ok := fired(late); !ok || !at.Equal(start.Add(3*time.Second)) {
+		t.Errorf("3s timer fired = %v at %v, want at %v", ok, at, start.Add(3*time.Second))
+	}
+	if _, ok := fired(stopped); ok {
+		t.Error("stopped timer fired")
+	}
+	if got, want := clk.Now(), start.Add(5999*time.Millisecond); !got.Equal(want) {
+		t.Errorf("Now() = %v, want %v", got, want)
+	}
+
+	// A jump moves the wall clock only: the timer still waits its whole duration, and fires at the new wall time
+	jumped := clk.NewTimer(time.Second)
+	clk.Jump(-time.Hour)
+	clk.Advance(500 * time.Millisecond)
+	if _, ok := fired(jumped); ok {
+		t.Fatal("timer fired early after a jump")
+	}
+	clk.Advance(500 * time.Millisecond)
+	if at, ok := fired(jumped); !ok || !at.Equal(start.Add(6999*time.Millisecond-time.Hour)) {
+		t.Errorf("timer after a jump fired = %v at %v", ok, at)
+	}
+	if clk.armed() != 0 {
+		t.Errorf("%d timers still armed, want 0", clk.armed())
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds every setting of the clock server, already validated.
+type config struct {
+	addr            listenAddr
+	unixMode        fs.FileMode // Permissions of the socket file when listening on a Unix socket
+	interval        time.Duration
+	align           time.Duration // Ticks fire on multiples of this on the wall clock instead of every interval, 0 disables it
+	format          timeFormat
+	location        *time.Location
+	shutdownTimeout time.Duration
+
+	maxConns     int           // Concurrent connections allowed, 0 means no limit
+	overflow     string        // What happens to connections over maxConns: "reject" or "queue"
+	writeTimeout time.Duration // Longest time a single write may take
+	maxLag       int           // Ticks a client may fall behind before being evicted, 0 disables eviction
+
+	adminAddr string // Address of the HTTP admin listener (metrics and health), empty disables it
+	httpAddr  string // Address of the HTTP front-ends (SSE, WebSocket and the clock page), empty disables them
+	sntpAddr  string // UDP address of the SNTP server, empty disables it
+	rpcAddr   string // Address of the JSON-RPC time service, empty disables it
+
+	logFormat string // "text" or "json"
+	logLevel  slog.Level
+
+	tlsCert       string // Certificate and key files (PEM) for TLS
+	tlsKey        string
+	tlsSelfSigned bool   // Generates an in-memory certificate instead of loading one
+	tlsClientCA   string // CA file (PEM) client certificates must be signed by, enables mutual TLS
+
+	filter        ipFilter // Which client addresses may connect
+	ipRate        float64  // New connections per second allowed from one address, 0 disables the limit
+	ipBurst       int      // New connections one address may open at once before ipRate kicks in
+	maxConnsPerIP int      // Concurrent connections allowed from one address, 0 means no limit
+
+	proxyTrusted []netip.Prefix // Load balancers whose PROXY header is read, see proxy.go
+
+	configFile string // JSON file read at startup and on SIGHUP, see configfile.go
+}
+
+// loadConfig reads flags, falling back to environment variables and then to the defaults.
+// Flags win over environment variables, so a single copy can still be tweaked from the command line.
+// https://pkg.go.dev/flag
+func loadConfig(args []string) (config, error) {
+	flags := flag.NewFlagSet("tour5", flag.ExitOnError)
+	addr := flags.String("addr", envOr("TOUR5_ADDR", ":8000"), "Address to listen on: host:port, tcp://host:port, unix:///path.sock or systemd://[name] (env TOUR5_ADDR)")
+	unixMode := flags.String("unix-mode", envOr("TOUR5_UNIX_MODE", "0660"), "Permissions (octal) of the socket file when listening on unix:// (env TOUR5_UNIX_MODE)")
+	interval := flags.String("interval", envOr("TOUR5_INTERVAL", "1s"), "Time between ticks, e.g. 500ms or 2s (env TOUR5_INTERVAL)")
+	align := flags.String("align", envOr("TOUR5_ALIGN", "off"), "Fire ticks right after each wall clock boundary: off, second, minute or a period such as 5s (replaces -interval) (env TOUR5_ALIGN)")
+	format := flags.String("format", envOr("TOUR5_FORMAT", "clock"), "Tick format: clock, rfc3339, rfc3339nano, kitchen, unix, unixmilli or a Go layout (env TOUR5_FORMAT)")
+	location := flags.String("tz", envOr("TOUR5_TZ", "Local"), "Time zone used for the ticks, e.g. UTC or America/Sao_Paulo (env TOUR5_TZ)")
+	shutdownTimeout := flags.String("shutdown-timeout", envOr("TOUR5_SHUTDOWN_TIMEOUT", "5s"), "How long to wait for active connections to finish before closing them (env TOUR5_SHUTDOWN_TIMEOUT)")
+	maxConns := flags.String("max-conns", envOr("TOUR5_MAX_CONNS", "0"), "Maximum concurrent connections, 0 means no limit (env TOUR5_MAX_CONNS)")
+	overflow := flags.String("overflow", envOr("TOUR5_OVERFLOW", "reject"), "What to do with connections over the limit: reject or queue (env TOUR5_OVERFLOW)")
+	writeTimeout := flags.String("write-timeout", envOr("TOUR5_WRITE_TIMEOUT", "5s"), "Longest time a single write to a client may take (env TOUR5_WRITE_TIMEOUT)")
+	maxLag := flags.String("max-lag", envOr("TOUR5_MAX_LAG", "5"), "Ticks a client may fall behind before being evicted, 0 disables eviction (env TOUR5_MAX_LAG)")
+	adminAddr := flags.String("admin-addr", envOr("TOUR5_ADMIN_ADDR", ""), "Address of the HTTP admin listener serving /metrics and /healthz, empty disables it (env TOUR5_ADMIN_ADDR)")
+	httpAddr := flags.String("http-addr", envOr("TOUR5_HTTP_ADDR", ""), "Address of the HTTP front-ends (/stream, /ws and a clock page), empty disables them (env TOUR5_HTTP_ADDR)")
+	sntpAddr := flags.String("sntp-addr", envOr("TOUR5_SNTP_ADDR", ""), "UDP address of the SNTP (RFC 4330) server, e.g. :1123; empty disables it (env TOUR5_SNTP_ADDR)")
+	rpcAddr := flags.String("rpc-addr", envOr("TOUR5_RPC_ADDR", ""), "Address of the JSON-RPC time service (Time.Now, Time.Convert, Time.Until), e.g. :8004; empty disables it (env TOUR5_RPC_ADDR)")
+	logFormat := flags.String("log-format", envOr("TOUR5_LOG_FORMAT", "text"), "Log output: text or json (env TOUR5_LOG_FORMAT)")
+	logLevel := flags.String("log-level", envOr("TOUR5_LOG_LEVEL", "info"), "Lowest level logged: debug, info, warn or error (env TOUR5_LOG_LEVEL)")
+	tlsCert := flags.String("tls-cert", envOr("TOUR5_TLS_CERT", ""), "Certificate file (PEM), enables TLS together with -tls-key (env TOUR5_TLS_CERT)")
+	tlsKey := flags.String("tls-key", envOr("TOUR5_TLS_KEY", ""), "Private key file (PEM) of -tls-cert (env TOUR5_TLS_KEY)")
+	tlsSelfSigned := flags.Bool("tls-self-signed", false, "Enable TLS with an ephemeral self-signed certificate, for local use (env TOUR5_TLS_SELF_SIGNED)")
+	tlsClientCA := flags.String("tls-client-ca", envOr("TOUR5_TLS_CLIENT_CA", ""), "CA file (PEM) that client certificates must be signed by, enables mutual TLS (env TOUR5_TLS_CLIENT_CA)")
+	allow := flags.String("allow", envOr("TOUR5_ALLOW", ""), "Comma-separated CIDRs or addresses allowed to connect, empty allows everyone not denied (env TOUR5_ALLOW)")
+	deny := flags.String("deny", envOr("TOUR5_DENY", ""), "Comma-separated CIDRs or addresses never allowed to connect, wins over -allow (env TOUR5_DENY)")
+	ipRate := flags.String("ip-rate", envOr("TOUR5_IP_RATE", "0"), "New connections per second allowed from one address, e.g. 0.5; 0 disables the limit (env TOUR5_IP_RATE)")
+	ipBurst := flags.String("ip-burst", envOr("TOUR5_IP_BURST", "5"), "New connections one address may open in a burst before -ip-rate applies (env TOUR5_IP_BURST)")
+	maxConnsPerIP := flags.String("max-conns-per-ip", envOr("TOUR5_MAX_CONNS_PER_IP", "0"), "Maximum concurrent connections from one address, 0 means no limit (env TOUR5_MAX_CONNS_PER_IP)")
+	proxyTrusted := flags.String("proxy-trusted", envOr("TOUR5_PROXY_TRUSTED", ""), "Comma-separated CIDRs of load balancers that must send a PROXY protocol (v1 or v2) header, empty disables it (env TOUR5_PROXY_TRUSTED)")
+	configFile := flags.String("config", envOr("TOUR5_CONFIG", ""), "JSON config file, reloaded on SIGHUP; its settings win over flags and environment (env TOUR5_CONFIG)")
+	flags.Parse(args)
+
+	var cfg config
+	var err error
+
+	// Collecting every problem instead of stopping at the first one, so a bad setup is fixed in one go.
+	// https://pkg.go.dev/errors#Join
+	var errs []error
+
+	if cfg.addr, err = parseListenAddr(*addr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid address %q: %w", *addr, err))
+	}
+	if mode, err := strconv.ParseUint(*unixMode, 8, 32); err != nil || mode > 0o777 {
+		errs = append(errs, fmt.Errorf("invalid socket permissions %q: must be octal, such as 0660", *unixMode))
+	} else {
+		cfg.unixMode = fs.FileMode(mode)
+	}
+
+	if cfg.interval, err = parsePositiveDuration(*interval); err != nil {
+		errs = append(errs, fmt.Errorf("invalid interval %q: %w", *interval, err))
+	}
+	if cfg.align, err = parseAlign(*align); err != nil {
+		errs = append(errs, fmt.Errorf("invalid alignment %q: %w", *align, err))
+	}
+	if cfg.shutdownTimeout, err = parsePositiveDuration(*shutdownTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("invalid shutdown timeout %q: %w", *shutdownTimeout, err))
+	}
+	if cfg.format, err = parseFormat(*format); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.location, err = time.LoadLocation(*location); err != nil {
+		errs = append(errs, fmt.Errorf("invalid time zone %q: %w", *location, err))
+	}
+	if cfg.maxConns, err = parseNonNegativeInt(*maxConns); err != nil {
+		errs = append(errs, fmt.Errorf("invalid connection limit %q: %w", *maxConns, err))
+	}
+	if cfg.overflow = strings.ToLower(*overflow); cfg.overflow != "reject" && cfg.overflow != "queue" {
+		errs = append(errs, fmt.Errorf("invalid overflow mode %q: must be reject or queue", *overflow))
+	}
+	if cfg.filter.allow, err = parsePrefixes(strings.Split(*allow, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid allow list: %w", err))
+	}
+	if cfg.filter.deny, err = parsePrefixes(strings.Split(*deny, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid deny list: %w", err))
+	}
+	if cfg.ipRate, err = strconv.ParseFloat(*ipRate, 64); err != nil || cfg.ipRate < 0 {
+		errs = append(errs, fmt.Errorf("invalid per-IP rate %q: must be a number of connections per second, 0 or more", *ipRate))
+	}
+	if cfg.ipBurst, err = parseNonNegativeInt(*ipBurst); err != nil || cfg.ipBurst == 0 {
+		errs = append(errs, fmt.Errorf("invalid per-IP burst %q: must be at least 1", *ipBurst))
+	}
+	if cfg.maxConnsPerIP, err = parseNonNegativeInt(*maxConnsPerIP); err != nil {
+		errs = append(errs, fmt.Errorf("invalid per-IP connection limit %q: %w", *maxConnsPerIP, err))
+	}
+	if cfg.proxyTrusted, err = parsePrefixes(strings.Split(*proxyTrusted, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid PROXY protocol upstream list: %w", err))
+	}
+	if cfg.writeTimeout, err = parsePositiveDuration(*writeTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("invalid write timeout %q: %w", *writeTimeout, err))
+	}
+	if cfg.maxLag, err = parseNonNegativeInt(*maxLag); err != nil {
+		errs = append(errs, fmt.Errorf("invalid maximum lag %q: %w", *maxLag, err))
+	}
+	if *adminAddr != "" {
+		if _, _, err := net.SplitHostPort(*adminAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid admin address %q: %w", *adminAddr, err))
+		}
+	}
+	cfg.adminAddr = *adminAddr
+	if *httpAddr != "" {
+		if _, _, err := net.SplitHostPort(*httpAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid HTTP address %q: %w", *httpAddr, err))
+		}
+	}
+	cfg.httpAddr = *httpAddr
+	if *sntpAddr != "" {
+		if _, _, err := net.SplitHostPort(*sntpAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid SNTP address %q: %w", *sntpAddr, err))
+		}
+	}
+	cfg.sntpAddr = *sntpAddr
+	if *rpcAddr != "" {
+		if _, _, err := net.SplitHostPort(*rpcAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid RPC address %q: %w", *rpcAddr, err))
+		}
+	}
+	cfg.rpcAddr = *rpcAddr
+
+	if cfg.logFormat, err = parseLogFormat(*logFormat); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.logLevel, err = parseLogLevel(*logLevel); err != nil {
+		errs = append(errs, err)
+	}
+
+	cfg.tlsCert, cfg.tlsKey, cfg.tlsClientCA = *tlsCert, *tlsKey, *tlsClientCA
+	if cfg.tlsSelfSigned, err = boolSetting(flags, "tls-self-signed", "TOUR5_TLS_SELF_SIGNED", *tlsSelfSigned); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateTLS(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	cfg.configFile = *configFile
+
+	return cfg, errors.Join(errs...)
+}
+
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// boolSetting returns the value of a boolean flag, or of its environment variable when the flag was not set.
+// Boolean flags are special (they work without a value, as in "-tls-self-signed"), so they cannot take
+// their default from envOr like the others without making a bad environment value silently count as false.
+func boolSetting(flags *flag.FlagSet, name, env string, value bool) (bool, error) {
+	set := false
+	flags.Visit(func(f *flag.Flag) { set = set || f.Name == name }) // Visit only goes through the flags that were set
+	raw, ok := os.LookupEnv(env)
+	if set || !ok {
+		return value, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be true or false", env, raw)
+	}
+	return value, nil
+}
+
+func parsePositiveDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("must be greater than zero")
+	}
+	return d, nil
+}
+
+// parseAlign turns "off", "second", "minute" or a duration into an alignment period (0 for off).
+func parseAlign(s string) (time.Duration, error) {
+	switch strings.ToLower(s) {
+	case "", "off":
+		return 0, nil
+	case "second":
+		return time.Second, nil
+	case "minute":
+		return time.Minute, nil
+	}
+	return parsePositiveDuration(s)
+}
+
+func parseNonNegativeInt(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return n, nil
+}
+
+// timeFormat turns a time into the text sent to clients, without the trailing newline.
+// Storing a function as a field lets presets that are not layouts (such as Unix seconds) live next to regular layouts.
+type timeFormat struct {
+	name   string
+	format func(time.Time) string
+}
+
+// Named presets. Anything else is treated as a Go layout.
+// https://pkg.go.dev/time#pkg-constants
+var formatPresets = map[string]func(time.Time) string{
+	"clock":       layoutFormat("15:04:05"),
+	"rfc3339":     layoutFormat(time.RFC3339),
+	"rfc3339nano": layoutFormat(time.RFC3339Nano),
+	"kitchen":     layoutFormat(time.Kitchen),
+	"unix":        func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	"unixmilli":   func(t time.Time) string { return strconv.FormatInt(t.UnixMilli(), 10) },
+}
+
+func parseFormat(spec string) (timeFormat, error) {
+	if format, ok := formatPresets[strings.ToLower(spec)]; ok {
+		return timeFormat{name: strings.ToLower(spec), format: format}, nil
+	}
+
+	// A layout that prints two very different times the same way has no time fields at all (e.g. "hello"), so it is most likely a typo.
+	first := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	second := time.Date(2017, time.November, 18, 9, 17, 19, 123456789, time.UTC)
+	if spec == "" || first.Format(spec) == second.Format(spec) {
+		return timeFormat{}, fmt.Errorf("invalid format %q: not a preset and not a Go layout with time fields", spec)
+	}
+	if strings.ContainsAny(spec, "\r\n") {
+		return timeFormat{}, fmt.Errorf("invalid format %q: line breaks are not allowed", spec)
+	}
+	return timeFormat{name: spec, format: layoutFormat(spec)}, nil
+}
+
+func layoutFormat(layout string) func(time.Time) string {
+	return func(t time.Time) string { return t.Format(layout) }
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+// Optional JSON config file (-config), read at startup and again on SIGHUP:
+//
+//	{
+//	  "addr": ":8000",
+//	  "interval": "1s",
+//	  "align": "second",
+//	  "format": "rfc3339",
+//	  "tz": "America/Sao_Paulo",
+//	  "max_conns": 100,
+//	  "allow": ["127.0.0.0/8", "10.0.0.0/8"],
+//	  "deny": ["10.0.0.13"],
+//	  "ip_rate": 0.5,
+//	  "ip_burst": 5,
+//	  "max_conns_per_ip": 10
+//	}
+//
+// Every field is optional and wins over the flag or environment variable with the same meaning.
+// Pointers tell "not in the file" (nil) apart from "set to the zero value" (e.g. "max_conns": 0).
+type fileConfig struct {
+	Addr     *string  `json:"addr"`
+	Interval *string  `json:"interval"`
+	Align    *string  `json:"align"`
+	Format   *string  `json:"format"`
+	TZ       *string  `json:"tz"`
+	MaxConns *int     `json:"max_conns"`
+	Allow    []string `json:"allow"`
+	Deny     []string `json:"deny"`
+
+	IPRate        *float64 `json:"ip_rate"`
+	IPBurst       *int     `json:"ip_burst"`
+	MaxConnsPerIP *int     `json:"max_conns_per_ip"`
+}
+
+// withConfigFile returns base with the settings of its config file applied, if it has one.
+// base is left untouched, so it can be used again on the next reload.
+func withConfigFile(base config) (config, error) {
+	cfg := base
+	if base.configFile == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(base.configFile)
+	if err != nil {
+		return cfg, err
+	}
+	var file fileConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields() // A typo in a field name is an error instead of a setting silently ignored
+	if err := decoder.Decode(&file); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", base.configFile, err)
+	}
+
+	var errs []error
+	if file.Addr != nil {
+		if cfg.addr, err = parseListenAddr(*file.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid addr %q: %w", *file.Addr, err))
+		}
+	}
+	if file.Interval != nil {
+		if cfg.interval, err = parsePositiveDuration(*file.Interval); err != nil {
+			errs = append(errs, fmt.Errorf("invalid interval %q: %w", *file.Interval, err))
+		}
+	}
+	if file.Align != nil {
+		if cfg.align, err = parseAlign(*file.Align); err != nil {
+			errs = append(errs, fmt.Errorf("invalid align %q: %w", *file.Align, err))
+		}
+	}
+	if file.Format != nil {
+		if cfg.format, err = parseFormat(*file.Format); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if file.TZ != nil {
+		if cfg.location, err = time.LoadLocation(*file.TZ); err != nil {
+			errs = append(errs, fmt.Errorf("invalid tz %q: %w", *file.TZ, err))
+		}
+	}
+	if file.MaxConns != nil {
+		if *file.MaxConns < 0 {
+			errs = append(errs, fmt.Errorf("invalid max_conns %d: must not be negative", *file.MaxConns))
+		}
+		cfg.maxConns = *file.MaxConns
+	}
+	if file.Allow != nil {
+		if cfg.filter.allow, err = parsePrefixes(file.Allow); err != nil {
+			errs = append(errs, fmt.Errorf("invalid allow list: %w", err))
+		}
+	}
+	if file.Deny != nil {
+		if cfg.filter.deny, err = parsePrefixes(file.Deny); err != nil {
+			errs = append(errs, fmt.Errorf("invalid deny list: %w", err))
+		}
+	}
+	if file.IPRate != nil {
+		if *file.IPRate < 0 {
+			errs = append(errs, fmt.Errorf("invalid ip_rate %g: must not be negative", *file.IPRate))
+		}
+		cfg.ipRate = *file.IPRate
+	}
+	if file.IPBurst != nil {
+		if *file.IPBurst < 1 {
+			errs = append(errs, fmt.Errorf("invalid ip_burst %d: must be at least 1", *file.IPBurst))
+		}
+		cfg.ipBurst = *file.IPBurst
+	}
+	if file.MaxConnsPerIP != nil {
+		if *file.MaxConnsPerIP < 0 {
+			errs = append(errs, fmt.Errorf("invalid max_conns_per_ip %d: must not be negative", *file.MaxConnsPerIP))
+		}
+		cfg.maxConnsPerIP = *file.MaxConnsPerIP
+	}
+	if err := errors.Join(errs...); err != nil {
+		return cfg, fmt.Errorf("invalid %s: %w", base.configFile, err)
+	}
+	return cfg, nil
+}
+
+// reload reads the config file again and applies what can change while running.
+// An invalid file is rejected as a whole, the running configuration stays as it was.
+func (s *server) reload() {
+	current := s.config()
+	if current.configFile == "" {
+		slog.Warn("Nothing to reload, the server was started without -config")
+		return
+	}
+
+	next, err := withConfigFile(s.base)
+	if err != nil {
+		slog.Error("Invalid configuration, keeping the current one", "err", err)
+		return
+	}
+
+	// The listen address cannot change without a new listener: keeping the current one and saying so
+	if next.addr != current.addr {
+		slog.Warn("The listen address changed, it only takes effect after a restart (SIGUSR2 or a new process)", "current", current.addr.String(), "new", next.addr.String())
+		next.addr = current.addr
+	}
+
+	var changed []string
+	if next.interval != current.interval {
+		changed = append(changed, "interval")
+	}
+	if next.align != current.align {
+		changed = append(changed, "align")
+	}
+	if next.format.name != current.format.name {
+		changed = append(changed, "format")
+	}
+	if next.location.String() != current.location.String() {
+		changed = append(changed, "tz")
+	}
+	if next.maxConns != current.maxConns {
+		changed = append(changed, "max_conns")
+	}
+	if !slices.Equal(next.filter.allow, current.filter.allow) {
+		changed = append(changed, "allow")
+	}
+	if !slices.Equal(next.filter.deny, current.filter.deny) {
+		changed = append(changed, "deny")
+	}
+	if next.ipRate != current.ipRate || next.ipBurst != current.ipBurst || next.maxConnsPerIP != current.maxConnsPerIP {
+		changed = append(changed, "per-IP limits") // Read from the config on every new connection, nothing else to do
+	}
+
+	// Existing handlers pick the new values up: the broadcaster formats and paces their ticks,
+	// the limit is shared, and the filter is checked against every open connection right here.
+	s.cfg.Store(&next)
+	s.ticks.setConfig(&next)
+	s.limit.setMax(next.maxConns)
+	s.enforceFilter(next.filter)
+
+	slog.Info("Configuration reloaded", "file", next.configFile, "changed", changed)
+}
+
+// enforceFilter closes open connections whose address is no longer allowed.
+func (s *server) enforceFilter(filter ipFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		ip, ok := remoteIP(conn.RemoteAddr())
+		if !ok {
+			continue
+		}
+		if allowed, why := filter.allowed(ip); !allowed {
+			slog.Warn("Closing connection no longer allowed", "remote", conn.RemoteAddr().String(), "why", why)
+			conn.Close()
+		}
+	}
+}
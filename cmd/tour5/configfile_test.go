@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects log records from every goroutine of the server.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the default logger to a buffer until the test ends.
+func captureLogs(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	prev, prevWriter, prevFlags := slog.Default(), log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() {
+		slog.SetDefault(prev)
+		log.SetOutput(prevWriter) // SetDefault pointed the log package at the buffer too
+		log.SetFlags(prevFlags)
+	})
+	return logs
+}
+
+// writeConfigFile replaces the config file at path with content.
+func writeConfigFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialFrom connects to addr from the local address from, closing the connection when the test ends.
+func dialFrom(t *testing.T, from, addr string) net.Conn {
+	t.Helper()
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(from)}, Timeout: 5 * time.Second}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// The tests below call reload directly, which is what endServer does on SIGHUP.
+
+func TestReloadAppliesToOpenConnections(t *testing.T) {
+	logs := captureLogs(t)
+	path := filepath.Join(t.TempDir(), "tour5.json")
+	writeConfigFile(t, path, `{"interval": "1h", "format": "clock"}`)
+	srv, addr := startLoopback(t, "-config", path, "-overflow", "reject")
+
+	conn := dialFrom(t, "127.0.0.1", addr)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || strings.Count(line, ":") != 2 {
+		t.Fatalf("first tick = %q, %v; want the clock format", line, err)
+	}
+
+	writeConfigFile(t, path, `{"interval": "50ms", "format": "rfc3339", "max_conns": 1}`)
+	srv.reload()
+	if !strings.Contains(logs.String(), `msg="Configuration reloaded"`) || !strings.Contains(logs.String(), "changed=\"[interval format max_conns]\"") {
+		t.Errorf("logs do not report the reload:\n%s", logs)
+	}
+
+	// Without the new interval the next tick would be an hour away, and it comes in the new format
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("no tick after the reload: %v", err)
+	}
+	if _, err := time.Parse(time.RFC3339, strings.TrimSpace(line)); err != nil {
+		t.Errorf("tick after the reload = %q, want RFC 3339", line)
+	}
+
+	// The open connection holds the only slot now
+	second := dialFrom(t, "127.0.0.1", addr)
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(second).ReadString('\n'); err != nil || line != "ERR server full, try again later\n" {
+		t.Errorf("second connection got %q, %v; want it rejected as over the new limit", line, err)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // Empty to remove the file
+		logged  string
+	}{
+		{name: "invalid value", content: `{"interval": "soon"}`, logged: `invalid interval \"soon\"`},
+		{name: "one bad value among good ones", content: `{"format": "rfc3339", "tz": "Mars/Olympus"}`, logged: `invalid tz \"Mars/Olympus\"`},
+		{name: "unknown key", content: `{"intervall": "1s"}`, logged: `unknown field \"intervall\"`},
+		{name: "not JSON", content: `interval = 1s`, logged: "parsing"},
+		{name: "file removed", logged: "no such file or directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			path := filepath.Join(t.TempDir(), "tour5.json")
+			writeConfigFile(t, path, `{"interval": "1h", "format": "kitchen"}`)
+			srv, _ := startLoopback(t, "-config", path)
+
+			if tt.content == "" {
+				os.Remove(path)
+			} else {
+				writeConfigFile(t, path, tt.content)
+			}
+			srv.reload()
+
+			if cfg := srv.config(); cfg.interval != time.Hour || cfg.format.name != "kitchen" {
+				t.Errorf("after the reload: interval %v, format %q; want the old 1h and kitchen", cfg.interval, cfg.format.name)
+			}
+			out := logs.String()
+			if !strings.Contains(out, "Invalid configuration, keeping the current one") || !strings.Contains(out, tt.logged) {
+				t.Errorf("logs do not explain the rejected file (want %q):\n%s", tt.logged, out)
+			}
+		})
+	}
+}
+
+func TestReloadListenAddressNeedsRestart(t *testing.T) {
+	logs := captureLogs(t)
+	path := filepath.Join(t.TempDir(), "tour5.json")
+	writeConfigFile(t, path, `{"addr": "127.0.0.1:8000"}`)
+	srv, _ := startLoopback(t, "-config", path)
+
+	writeConfigFile(t, path, `{"addr": "127.0.0.1:9000", "interval": "2s"}`)
+	srv.reload()
+
+	cfg := srv.config()
+	if cfg.addr.address != "127.0.0.1:8000" {
+		t.Errorf("addr = %q after the reload, want the old one until a restart", cfg.addr.address)
+	}
+	if cfg.interval != 2*time.Second {
+		t.Errorf("interval = %v, want the rest of the file applied", cfg.interval)
+	}
+	if out := logs.String(); !strings.Contains(out, "only takes effect after a restart") || !strings.Contains(out, "new=127.0.0.1:9000") {
+		t.Errorf("logs do not report the address change:\n%s", out)
+	}
+}
+
+func TestReloadDenyClosesConnections(t *testing.T) {
+	logs := captureLogs(t)
+	path := filepath.Join(t.TempDir(), "tour5.json")
+	writeConfigFile(t, path, `{}`)
+	srv, addr := startLoopback(t, "-config", path)
+
+	denied := dialFrom(t, "127.0.0.2", addr)
+	kept := dialFrom(t, "127.0.0.3", addr)
+	denied.SetReadDeadline(time.Now().Add(5 * time.Second))
+	kept.SetReadDeadline(time.Now().Add(5 * time.Second))
+	deniedReader, keptReader := bufio.NewReader(denied), bufio.NewReader(kept)
+	for _, r := range []*bufio.Reader{deniedReader, keptReader} {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatalf("no first tick: %v", err)
+		}
+	}
+
+	writeConfigFile(t, path, `{"deny": ["127.0.0.2"]}`)
+	srv.reload()
+
+	// The denied client is cut off (after whatever ticks were already on the way), the other one goes on
+	if _, err := io.ReadAll(deniedReader); err != nil {
+		t.Errorf("denied client: reading until the server closed the connection: %v", err)
+	}
+	for range 3 {
+		if _, err := keptReader.ReadString('\n'); err != nil {
+			t.Fatalf("client still allowed lost its ticks: %v", err)
+		}
+	}
+	if out := logs.String(); !strings.Contains(out, "Closing connection no longer allowed") || !strings.Contains(out, "127.0.0.2/32") {
+		t.Errorf("logs do not report the closed connection:\n%s", out)
+	}
+}
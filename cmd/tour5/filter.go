@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// ipFilter decides which client addresses may connect.
+// The deny list always wins; when the allow list is not empty, only addresses in it get through.
+// https://pkg.go.dev/net/netip
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parsePrefixes parses CIDRs ("10.0.0.0/8") and single addresses ("192.168.0.10", seen as a /32 or /128).
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or CIDR %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allowed reports whether addr may connect, and if not, why.
+func (f ipFilter) allowed(addr netip.Addr) (bool, string) {
+	addr = addr.Unmap() // "::ffff:127.0.0.1" (IPv4 seen through an IPv6 socket) is matched as 127.0.0.1
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return false, "address is in the deny list (" + prefix.String() + ")"
+		}
+	}
+	if len(f.allow) == 0 {
+		return true, ""
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return true, ""
+		}
+	}
+	return false, "address is not in the allow list"
+}
+
+// remoteIP is the IP address of a TCP peer. Unix sockets have none, and are never filtered.
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return tcpAddr.AddrPort().Addr().Unmap(), true
+}
+
+// screen checks a new connection against the IP filter and the per-IP limits (see ratelimit.go),
+// telling rejected clients why in a single line before their connection is closed.
+// Connections it lets through hold a per-IP slot, given back with s.perIP.release.
+func (s *server) screen(c *client) bool {
+	ip, ok := remoteIP(c.conn.RemoteAddr())
+	if !ok {
+		return true
+	}
+
+	cfg := s.config()
+	reason := reasonDenied
+	allowed, why := cfg.filter.allowed(ip)
+	if allowed {
+		reason = reasonRateLimited
+		allowed, why = s.perIP.acquire(ip, cfg.ipRate, cfg.ipBurst, cfg.maxConnsPerIP, s.clock.Now())
+	}
+	if allowed {
+		return true
+	}
+
+	c.log.Warn("Rejecting connection", "reason", reason, "why", why, c.age())
+	c.conn.SetWriteDeadline(time.Now().Add(cfg.writeTimeout))
+	fmt.Fprintf(c.conn, "ERR %s\n", why)
+	s.metrics.reject(reason)
+	return false
+}
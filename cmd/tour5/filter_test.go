@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	mustPrefixes := func(entries ...string) []netip.Prefix {
+		prefixes, err := parsePrefixes(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prefixes
+	}
+
+	tests := []struct {
+		name    string
+		filter  ipFilter
+		addr    string
+		allowed bool
+		why     string
+	}{
+		{name: "no lists", addr: "203.0.113.7", allowed: true},
+		{name: "in the allow list", filter: ipFilter{allow: mustPrefixes("10.0.0.0/8")}, addr: "10.1.2.3", allowed: true},
+		{name: "outside the allow list", filter: ipFilter{allow: mustPrefixes("10.0.0.0/8")}, addr: "192.168.0.1", why: "address is not in the allow list"},
+		{name: "in the deny list", filter: ipFilter{deny: mustPrefixes("192.168.0.0/16")}, addr: "192.168.4.5", why: "address is in the deny list (192.168.0.0/16)"},
+		{name: "outside the deny list", filter: ipFilter{deny: mustPrefixes("192.168.0.0/16")}, addr: "10.0.0.1", allowed: true},
+		{name: "deny wins over allow", filter: ipFilter{allow: mustPrefixes("10.0.0.0/8"), deny: mustPrefixes("10.0.0.5")}, addr: "10.0.0.5", why: "address is in the deny list (10.0.0.5/32)"},
+		{name: "single address", filter: ipFilter{allow: mustPrefixes("127.0.0.2")}, addr: "127.0.0.3", why: "address is not in the allow list"},
+		{name: "IPv4 through an IPv6 socket", filter: ipFilter{deny: mustPrefixes("127.0.0.0/8")}, addr: "::ffff:127.0.0.1", why: "address is in the deny list (127.0.0.0/8)"},
+		{name: "IPv6", filter: ipFilter{allow: mustPrefixes("2001:db8::/32")}, addr: "2001:db8::1", allowed: true},
+		{name: "IPv6 outside the allow list", filter: ipFilter{allow: mustPrefixes("2001:db8::/32")}, addr: "::1", why: "address is not in the allow list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, why := tt.filter.allowed(netip.MustParseAddr(tt.addr))
+			if allowed != tt.allowed || why != tt.why {
+				t.Errorf("allowed(%s) = %v, %q; want %v, %q", tt.addr, allowed, why, tt.allowed, tt.why)
+			}
+		})
+	}
+}
+
+// TestRejectionLine runs the server with TLS on loopback and connects from other addresses of 127.0.0.0/8
+// (all of them are local on Linux), one per case. Rejected clients must get their "ERR" line in plain text
+// without sending anything, accepted ones get a TLS handshake and ticks.
+func TestRejectionLine(t *testing.T) {
+	_, addr := startLoopback(t, "-tls-self-signed", "-deny", "127.0.0.2", "-max-conns-per-ip", "1", "-ip-rate", "0.001", "-ip-burst", "2")
+
+	tests := []struct {
+		name   string
+		from   string
+		open   int    // Connections from the same address kept open (TLS done) before the one checked
+		closed int    // Connections from the same address opened and closed before, which only use up tokens
+		want   string // Expected first line, empty when the client must be accepted
+	}{
+		{name: "denied", from: "127.0.0.2", want: "ERR address is in the deny list (127.0.0.2/32)\n"},
+		{name: "accepted", from: "127.0.0.3"},
+		{name: "too many open", from: "127.0.0.4", open: 1, want: "ERR too many connections from 127.0.0.4 (limit 1)\n"},
+		{name: "too many new", from: "127.0.0.5", closed: 2, want: "ERR too many new connections from 127.0.0.5, slow down\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range tt.closed {
+				dialTLSFrom(t, tt.from, addr).Close()
+				time.Sleep(100 * time.Millisecond) // Lets the server give the slot back
+			}
+			for range tt.open {
+				dialTLSFrom(t, tt.from, addr)
+			}
+
+			conn := dialFrom(t, tt.from, addr)
+			if tt.want == "" {
+				tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+				tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+				if _, err := bufio.NewReader(tlsConn).ReadString('\n'); err != nil {
+					t.Fatalf("no tick over TLS: %v", err)
+				}
+				return
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading the rejection in plain text: %v", err)
+			}
+			if line != tt.want {
+				t.Errorf("got %q, want %q", line, tt.want)
+			}
+		})
+	}
+}
+
+// dialTLSFrom is dialFrom with the TLS handshake done, which means the server accepted the client.
+func dialTLSFrom(t *testing.T, from, addr string) *tls.Conn {
+	t.Helper()
+	conn := tls.Client(dialFrom(t, from, addr), &tls.Config{InsecureSkipVerify: true})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake from %s: %v", from, err)
+	}
+	return conn
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The harness runs the real serve/serveClient/handleConn path without a network or real time:
+// connections are in-memory pipes handed out by pipeListener, and time is a fakeClock the test moves.
+
+// pipeListener is a net.Listener whose connections are the server ends of net.Pipe.
+// Accept can also be made to fail, the way a real listener does when the process runs out of file descriptors.
+type pipeListener struct {
+	conns  chan net.Conn
+	errs   chan error
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), errs: make(chan error), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// dial connects a new client, returning its end of the pipe once the server accepted the other one.
+func (l *pipeListener) dial(t *testing.T) net.Conn {
+	t.Helper()
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not accept within 5s")
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// fail makes the next Accept return err.
+func (l *pipeListener) fail(err error) {
+	l.errs <- err
+}
+
+// harness is a server running on a pipeListener and a fakeClock, stopped when the test ends.
+type harness struct {
+	srv      *server
+	clock    *fakeClock
+	listener *pipeListener
+	cancel   context.CancelCauseFunc
+	done     chan struct{} // Closed when serve returned
+
+	stopOnce        sync.Once
+	drained, forced int
+}
+
+// harnessStart is the fake clock's time when a harness starts.
+var harnessStart = time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+
+// startHarness starts a server with the default configuration in UTC, plus args (flags, as on the command line).
+func startHarness(t *testing.T, args ...string) *harness {
+	t.Helper()
+	cfg, err := loadConfig(append([]string{"-tz", "UTC"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{clock: newFakeClock(harnessStart), listener: newPipeListener(), done: make(chan struct{})}
+	h.srv = newServer(cfg, cfg, h.listener, h.clock)
+
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancelCause(context.Background())
+	go h.srv.ticks.run(ctx)
+	go func() {
+		h.srv.serve(ctx)
+		close(h.done)
+	}()
+	h.clock.waitArmed(t, 1) // The broadcaster is waiting for its first tick
+	t.Cleanup(func() { h.stop(time.Second) })
+	return h
+}
+
+// stop shuts the server down like main does, giving handlers timeout to finish.
+func (h *harness) stop(timeout time.Duration) (drained, forced int) {
+	h.stopOnce.Do(func() {
+		h.cancel(errors.New("test finished"))
+		h.listener.Close()
+		<-h.done
+		h.drained, h.forced = h.srv.drain(timeout)
+	})
+	return h.drained, h.forced
+}
+
+// tick lets one interval pass, so the broadcaster sends a tick. It first waits for the broadcaster's timer,
+// which it re-arms after every tick, so a tick is never skipped by advancing too early.
+func (h *harness) tick(t *testing.T) {
+	t.Helper()
+	h.clock.waitArmed(t, 1)
+	h.clock.Advance(h.srv.config().interval)
+}
+
+// waitDisconnect waits until the server recorded a connection ending for reason.
+func (h *harness) waitDisconnect(t *testing.T, reason string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.srv.metrics.mu.Lock()
+		n := h.srv.metrics.disconnects[reason]
+		h.srv.metrics.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no connection ended with %q after 5s", reason)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readLine(t *testing.T, r *bufio.Reader, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading a line: %v", err)
+	}
+	return line
+}
+
+func TestHarnessTickFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		first  string // Sent right after connecting, at harnessStart
+		second string // After one interval
+	}{
+		{name: "default", first: "12:00:00\n", second: "12:00:01\n"},
+		{name: "rfc3339", args: []string{"-format", "rfc3339"}, first: "2026-10-18T12:00:00Z\n", second: "2026-10-18T12:00:01Z\n"},
+		{name: "rfc3339nano", args: []string{"-format", "rfc3339nano", "-interval", "250ms"}, first: "2026-10-18T12:00:00Z\n", second: "2026-10-18T12:00:00.25Z\n"},
+		{name: "unix", args: []string{"-format", "unix", "-interval", "1m"}, first: "1792324800\n", second: "1792324860\n"},
+		{name: "kitchen in Tokyo", args: []string{"-format", "kitchen", "-tz", "Asia/Tokyo", "-interval", "1h"}, first: "9:00PM\n", second: "10:00PM\n"},
+		{name: "layout in Sao Paulo", args: []string{"-format", "Mon 15:04", "-tz", "America/Sao_Paulo", "-interval", "24h"}, first: "Sun 09:00\n", second: "Mon 09:00\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := startHarness(t, tt.args...)
+			conn := h.listener.dial(t)
+			r := bufio.NewReader(conn)
+
+			if got := readLine(t, r, conn); got != tt.first {
+				t.Errorf("first line = %q, want %q", got, tt.first)
+			}
+			h.tick(t)
+			if got := readLine(t, r, conn); got != tt.second {
+				t.Errorf("line after one interval = %q, want %q", got, tt.second)
+			}
+		})
+	}
+}
+
+func TestHarnessCommands(t *testing.T) {
+	h := startHarness(t)
+	conn := h.listener.dial(t)
+	r := bufio.NewReader(conn)
+	readLine(t, r, conn)
+
+	io.WriteString(conn, "TZ Asia/Tokyo\n")
+	if got := readLine(t, r, conn); got != "OK TZ Asia/Tokyo\n" {
+		t.Fatalf("reply = %q", got)
+	}
+	h.tick(t)
+	if got, want := readLine(t, r, conn), "21:00:01\n"; got != want {
+		t.Errorf("tick after TZ = %q, want %q", got, want)
+	}
+
+	io.WriteString(conn, "QUIT\n")
+	if got := readLine(t, r, conn); got != "OK QUIT\n" {
+		t.Fatalf("reply = %q", got)
+	}
+	h.waitDisconnect(t, reasonQuit)
+}
+
+func TestHarnessAcceptErrors(t *testing.T) {
+	h := startHarness(t)
+
+	// Accept failing (EMFILE and the like) must not stop the loop
+	h.listener.fail(errors.New("accept: too many open files"))
+	h.listener.fail(errors.New("accept: too many open files"))
+	conn := h.listener.dial(t)
+	if got := readLine(t, bufio.NewReader(conn), conn); got != "12:00:00\n" {
+		t.Errorf("first line after accept errors = %q", got)
+	}
+	if got := h.srv.metrics.acceptErrors.Load(); got != 2 {
+		t.Errorf("accept errors = %d, want 2", got)
+	}
+
+	// Once the listener is closed because of a shutdown, serve returns instead of counting an error
+	h.stop(time.Second)
+	select {
+	case <-h.done:
+	default:
+		t.Error("serve still running after shutdown")
+	}
+	if got := h.srv.metrics.acceptErrors.Load(); got != 2 {
+		t.Errorf("accept errors after shutdown = %d, want 2", got)
+	}
+}
+
+func TestHarnessClientDisconnect(t *testing.T) {
+	h := startHarness(t)
+	conn := h.listener.dial(t)
+	readLine(t, bufio.NewReader(conn), conn)
+	conn.Close()
+
+	// The server only finds out when it writes the next tick
+	h.tick(t)
+	h.waitDisconnect(t, reasonClientGone)
+	if got := h.srv.metrics.activeConns.Load(); got != 0 {
+		t.Errorf("active connections = %d, want 0", got)
+	}
+
+	// The age logged and recorded comes from the fake clock: one interval, not the real time the test took
+	h.srv.metrics.mu.Lock()
+	sum := h.srv.metrics.lifetimeSum
+	h.srv.metrics.mu.Unlock()
+	if sum != 1 {
+		t.Errorf("lifetime = %vs, want 1s", sum)
+	}
+}
+
+func TestHarnessShutdown(t *testing.T) {
+	h := startHarness(t, "-write-timeout", "1h") // Only the shutdown may end the stuck write below
+
+	// Reading along: the handler is waiting in select when the shutdown starts, and stops by itself
+	idle := h.listener.dial(t)
+	idleReader := bufio.NewReader(idle)
+	readLine(t, idleReader, idle)
+
+	// Not reading: the next tick blocks the handler in a write, a pipe has no buffer
+	stuck := h.listener.dial(t)
+	readLine(t, bufio.NewReader(stuck), stuck)
+	h.tick(t)
+	readLine(t, idleReader, idle)
+	time.Sleep(50 * time.Millisecond) // Gives the other handler time to reach the write
+
+	start := time.Now()
+	drained, forced := h.stop(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("shutdown took %v, the stuck write was not interrupted", elapsed)
+	}
+	if drained != 1 || forced != 1 {
+		t.Errorf("drained %d and forced %d connections, want 1 and 1", drained, forced)
+	}
+	for name, conn := range map[string]net.Conn{"idle": idle, "stuck": stuck} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Errorf("%s client: reading until the server closed the connection: %v", name, err)
+		}
+	}
+}
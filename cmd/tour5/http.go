@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// HTTP front-ends for the same tick stream:
+//
+//	/        a small page showing the live clock (over WebSocket)
+//	/stream  Server-Sent Events, one "data:" event per tick (try "curl -N")
+//	/ws      WebSocket, ticks as text messages, commands accepted as text messages
+//
+// Both streams end up in handleConn, so they share the broadcaster, the commands, the limits, the metrics
+// and the shutdown path with the raw TCP clients.
+
+// The page is embedded in the binary at build time
+// https://pkg.go.dev/embed
+//
+//go:embed clock.html
+var clockPage []byte
+
+// serveHTTP starts the HTTP front-ends on their own listener (using TLS when tlsCfg is not nil).
+// The returned server is shut down by the caller.
+func (s *server) serveHTTP(ctx context.Context, listener net.Listener, tlsCfg *tls.Config) *http.Server {
+	if tlsCfg != nil {
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(clockPage)
+	})
+	mux.HandleFunc("GET /stream", func(w http.ResponseWriter, r *http.Request) {
+		s.serveSSE(ctx, w, r)
+	})
+	mux.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
+		s.serveWebSocket(ctx, w, r)
+	})
+
+	httpSrv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	go func() {
+		if err := httpSrv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP listener failed", "err", err)
+		}
+	}()
+	slog.Info("Serving HTTP front-ends", "addr", listener.Addr().String(), "tls", tlsCfg != nil)
+	return httpSrv
+}
+
+func (s *server) serveSSE(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	// The stream's own context, so closing the connection (sseConn.Close) can stop handleConn
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, err := newSSEConn(w, r, cancel)
+	if err != nil {
+		// Without an address the filters and per-IP limits could not tell who this is
+		slog.Warn("Refusing event stream", "remote", r.RemoteAddr, "err", err)
+		http.Error(w, "unknown client address", http.StatusInternalServerError)
+		return
+	}
+
+	// https://html.spec.whatwg.org/multipage/server-sent-events.html
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	s.serveStream(ctx, conn, "sse")
+}
+
+func (s *server) serveWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		slog.Debug("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	s.serveStream(ctx, conn, "websocket")
+}
+
+// serveStream runs an HTTP stream like serve runs a TCP connection, but in the goroutine net/http gave us.
+func (s *server) serveStream(ctx context.Context, conn net.Conn, frontend string) {
+	if !s.enter() {
+		conn.Close()
+		return // Already draining, too late to start a new stream
+	}
+	defer s.wg.Done()
+
+	c := newClient(s.lastID.Add(1), conn, s.clock)
+	c.log = c.log.With("frontend", frontend)
+	c.log.Info("Connection accepted")
+	s.metrics.totalConns.Add(1)
+	s.track(conn)
+	if !s.screen(c) { // net/http already did any TLS, the "ERR" line goes in the stream
+		s.untrack(conn)
+		return
+	}
+	s.serveClient(ctx, c, s.handleConn)
+}
+
+// sseConn is an event stream seen as a net.Conn: every line written becomes a "data:" event.
+// Clients cannot send anything back, so reading ends right away.
+type sseConn struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	cancel context.CancelFunc // Of the context the stream is served with
+	local  net.Addr
+	remote net.Addr
+}
+
+func newSSEConn(w http.ResponseWriter, r *http.Request, cancel context.CancelFunc) (*sseConn, error) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &sseConn{w: w, rc: http.NewResponseController(w), cancel: cancel, remote: net.TCPAddrFromAddrPort(addrPort)}
+	c.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return c, nil
+}
+
+func (c *sseConn) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (c *sseConn) Write(p []byte) (int, error) {
+	var event strings.Builder
+	for line := range strings.Lines(string(p)) {
+		event.WriteString("data: " + strings.TrimSuffix(line, "\n") + "\n")
+	}
+	event.WriteString("\n") // A blank line ends the event
+	if _, err := io.WriteString(c.w, event.String()); err != nil {
+		return 0, err
+	}
+	// Without flushing, the event would sit in the response buffer
+	if err := c.rc.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the stream, also from another goroutine such as drain once the shutdown deadline passed:
+// cancelling its context stops handleConn, and a write deadline in the past frees a write stuck on a client
+// that stopped reading. net/http closes the response itself when the handler returns.
+func (c *sseConn) Close() error {
+	c.cancel()
+	return c.rc.SetWriteDeadline(time.Now())
+}
+
+func (c *sseConn) LocalAddr() net.Addr                { return c.local }
+func (c *sseConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *sseConn) SetDeadline(t time.Time) error      { return c.rc.SetWriteDeadline(t) }
+func (c *sseConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sseConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
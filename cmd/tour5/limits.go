@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// connLimit counts active connections against a maximum that can change while the server runs (SIGHUP).
+// Waiting connections need to know when a slot frees up or the maximum grows: "changed" is a channel
+// that gets closed (waking up every waiter at once) and replaced by a new one on every such change.
+type connLimit struct {
+	mu      sync.Mutex
+	active  int
+	max     int // 0 means no limit
+	changed chan struct{}
+}
+
+func newConnLimit(max int) *connLimit {
+	return &connLimit{max: max, changed: make(chan struct{})}
+}
+
+// tryAcquire takes a slot if there is one. When there is not, it returns the channel to wait on before trying again.
+// Both are decided under the same lock, so a slot freed in between cannot be missed.
+func (l *connLimit) tryAcquire() (bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max == 0 || l.active < l.max {
+		l.active++
+		return true, nil
+	}
+	return false, l.changed
+}
+
+func (l *connLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.notify()
+}
+
+// setMax changes the maximum. Connections above a lowered maximum are not closed, new ones wait until enough leave.
+func (l *connLimit) setMax(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.notify()
+}
+
+// notify wakes every waiter up, l.mu must be held.
+func (l *connLimit) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// admit takes a connection slot for c. When the server is full the connection is either
+// rejected with a message or waits (queued) until another connection finishes.
+// It returns false if the connection should be closed without being served.
+func (s *server) admit(ctx context.Context, c *client) bool {
+	ok, changed := s.limit.tryAcquire()
+	if ok {
+		return true
+	}
+
+	cfg := s.config()
+	if cfg.overflow == "reject" {
+		c.log.Warn("Rejecting connection, server full", "max_conns", cfg.maxConns, c.age())
+		c.conn.SetWriteDeadline(time.Now().Add(cfg.writeTimeout))
+		io.WriteString(c.conn, "ERR server full, try again later\n")
+		s.metrics.reject(reasonServerFull)
+		return false
+	}
+
+	c.log.Warn("Queueing connection, server full", "max_conns", cfg.maxConns)
+	for !ok {
+		select {
+		case <-changed:
+			ok, changed = s.limit.tryAcquire()
+		case <-ctx.Done():
+			s.metrics.disconnect(reasonShutdown)
+			return false
+		}
+	}
+	c.log.Info("Connection left the queue", c.age())
+	return true
+}
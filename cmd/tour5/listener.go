@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The listen address is a URL, so the server can run behind different supervisors:
+//
+//	:8000 or tcp://host:port     plain TCP
+//	unix:///run/clock.sock       Unix domain socket (unix://clock.sock for a relative path)
+//	systemd:// or systemd://name socket inherited from systemd (or anything speaking its protocol)
+type listenAddr struct {
+	scheme  string // "tcp", "unix" or "systemd"
+	address string // host:port, socket path, or name of the inherited socket (may be empty)
+}
+
+func parseListenAddr(raw string) (listenAddr, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "tcp://" + raw // Plain host:port, as accepted before URLs
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return listenAddr{}, err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return listenAddr{}, err
+		}
+		return listenAddr{scheme: "tcp", address: u.Host}, nil
+	case "unix":
+		path := u.Host + u.Path // "unix:///tmp/a.sock" has everything in Path, "unix://a.sock" in Host
+		if path == "" {
+			return listenAddr{}, errors.New("missing socket path")
+		}
+		return listenAddr{scheme: "unix", address: path}, nil
+	case "systemd":
+		return listenAddr{scheme: "systemd", address: u.Host}, nil
+	default:
+		return listenAddr{}, fmt.Errorf("unknown scheme %q, expected tcp, unix or systemd", u.Scheme)
+	}
+}
+
+// host is the host name or IP of a TCP address, empty for anything else.
+func (a listenAddr) host() string {
+	if a.scheme != "tcp" {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(a.address)
+	return host
+}
+
+// String is a in the form it is given on the command line.
+func (a listenAddr) String() string {
+	if a.scheme == "tcp" {
+		return a.address
+	}
+	return a.scheme + "://" + a.address
+}
+
+// listen opens the listener described by a.
+func listen(a listenAddr, unixMode fs.FileMode) (net.Listener, error) {
+	switch a.scheme {
+	case "unix":
+		return listenUnix(a.address, unixMode)
+	case "systemd":
+		return activationListener(a.address)
+	default:
+		return net.Listen("tcp", a.address)
+	}
+}
+
+// listenUnix listens on a Unix domain socket at path, first removing a socket file left behind by a server that crashed.
+// https://man7.org/linux/man-pages/man7/unix.7.html
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket, refusing to remove it", path)
+		}
+		// If something answers, the socket is in use. Otherwise nobody is listening and the file is stale.
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path) // Removes the file again when closed
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// First file descriptor passed by socket activation, 0, 1 and 2 being stdin, stdout and stderr
+const listenFDsStart = 3
+
+// activationListener takes over a listening socket inherited through systemd socket activation.
+// systemd starts the process with the sockets already open and describes them in environment variables:
+// LISTEN_PID (who they are meant for), LISTEN_FDS (how many) and LISTEN_FDNAMES (their names, separated by ":").
+// https://www.freedesktop.org/software/systemd/man/latest/sd_listen_fds.html
+func activationListener(name string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by socket activation (LISTEN_PID is missing or meant for another process)")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("no sockets passed by socket activation (LISTEN_FDS is missing or zero)")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Like sd_listen_fds(unset_environment=1): the variables are only meant for this process, not for its children
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(v)
+	}
+
+	index := 0
+	if name != "" {
+		if index = slices.Index(names, name); index < 0 || index >= count {
+			return nil, fmt.Errorf("no inherited socket named %q (names: %q)", name, strings.Join(names, ":"))
+		}
+	}
+
+	// Sockets we are not going to use must not leak into children either
+	for i := range count {
+		syscall.CloseOnExec(listenFDsStart + i)
+	}
+	return fileListener(listenFDsStart+index, "systemd:"+name)
+}
+
+// fileListener turns an inherited file descriptor into a net.Listener.
+func fileListener(fd int, name string) (net.Listener, error) {
+	file := os.NewFile(uintptr(fd), name)
+	if file == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer file.Close() // FileListener works on a duplicate, the original is not needed anymore
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not a listening socket: %w", fd, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    listenAddr
+		wantErr bool
+	}{
+		{raw: ":8000", want: listenAddr{scheme: "tcp", address: ":8000"}},
+		{raw: "tcp://127.0.0.1:8000", want: listenAddr{scheme: "tcp", address: "127.0.0.1:8000"}},
+		{raw: "unix:///run/clock.sock", want: listenAddr{scheme: "unix", address: "/run/clock.sock"}},
+		{raw: "unix://clock.sock", want: listenAddr{scheme: "unix", address: "clock.sock"}},
+		{raw: "systemd://", want: listenAddr{scheme: "systemd"}},
+		{raw: "systemd://clock", want: listenAddr{scheme: "systemd", address: "clock"}},
+		{raw: "8000", wantErr: true},
+		{raw: "unix://", wantErr: true},
+		{raw: "udp://:8000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseListenAddr(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseListenAddr(%q) error = %v, want error: %v", tt.raw, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseListenAddr(%q) = %+v, want %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, path string) // Leaves something at path before listening, or nothing
+		mode  os.FileMode
+		err   string // Part of the error, empty when listening must work
+	}{
+		{name: "no file yet", mode: 0o600},
+		{name: "other mode", mode: 0o666},
+		{
+			name: "stale socket",
+			setup: func(t *testing.T, path string) {
+				// What a crashed server leaves behind: the file, and nobody listening on it
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				l.(*net.UnixListener).SetUnlinkOnClose(false)
+				l.Close()
+			},
+			mode: 0o660,
+		},
+		{
+			name: "live socket",
+			setup: func(t *testing.T, path string) {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { l.Close() })
+				go func() {
+					for {
+						conn, err := l.Accept()
+						if err != nil {
+							return
+						}
+						conn.Close()
+					}
+				}()
+			},
+			mode: 0o660,
+			err:  "in use by another server",
+		},
+		{
+			name: "regular file",
+			setup: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, []byte("not a socket"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			mode: 0o660,
+			err:  "is not a socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clock.sock")
+			if tt.setup != nil {
+				tt.setup(t, path)
+			}
+			before, _ := os.Lstat(path)
+
+			l, err := listenUnix(path, tt.mode)
+			if tt.err != "" {
+				if err == nil {
+					l.Close()
+					t.Fatalf("listenUnix succeeded, want an error containing %q", tt.err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("listenUnix error = %v, want it to contain %q", err, tt.err)
+				}
+				// Whatever was there is left alone
+				if after, err := os.Lstat(path); err != nil || !os.SameFile(before, after) {
+					t.Errorf("%s was removed or replaced", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Type() != os.ModeSocket || info.Mode().Perm() != tt.mode {
+				t.Errorf("socket file mode = %v, want a socket with %v", info.Mode(), tt.mode)
+			}
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatalf("dialing the new socket: %v", err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestActivationListenerErrors(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name    string
+		env     map[string]string
+		socket  string
+		wantErr string
+	}{
+		{name: "nothing passed", env: map[string]string{}, wantErr: "LISTEN_PID is missing"},
+		{name: "meant for another process", env: map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}, wantErr: "meant for another process"},
+		{name: "no sockets", env: map[string]string{"LISTEN_PID": self, "LISTEN_FDS": "0"}, wantErr: "LISTEN_FDS is missing or zero"},
+		{name: "unknown name", env: map[string]string{"LISTEN_PID": self, "LISTEN_FDS": "2", "LISTEN_FDNAMES": "admin:clock"}, socket: "http", wantErr: `no inherited socket named "http" (names: "admin:clock")`},
+		{name: "name past the count", env: map[string]string{"LISTEN_PID": self, "LISTEN_FDS": "1", "LISTEN_FDNAMES": "admin:clock"}, socket: "clock", wantErr: `no inherited socket named "clock"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+				t.Setenv(v, tt.env[v]) // Also restores the previous values when the test ends
+				if _, ok := tt.env[v]; !ok {
+					os.Unsetenv(v)
+				}
+			}
+
+			listener, err := activationListener(tt.socket)
+			if err == nil {
+				listener.Close()
+				t.Fatal("activationListener succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestActivationListener fakes socket activation the way systemd does it: the test binary runs itself again
+// with two listening sockets as file descriptors 3 and 4, and LISTEN_PID/LISTEN_FDS/LISTEN_FDNAMES describing them.
+// LISTEN_PID has to be the child's own PID, which is only known once it runs, so a shell sets it to its own PID ($$)
+// and then execs the test binary, which keeps that PID.
+func TestActivationListener(t *testing.T) {
+	if name, ok := os.LookupEnv("TOUR5_TEST_ACTIVATION"); ok {
+		activatedChild(t, name)
+		return
+	}
+
+	var files []*os.File
+	var addrs []string
+	for range 2 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := listener.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener.Close() // The socket stays open through file, which only the child keeps
+		defer file.Close()
+		files = append(files, file)
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	for i, name := range []string{"admin", "clock"} {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`, os.Args[0], "-test.run=^TestActivationListener$", "-test.v")
+			cmd.Env = append(os.Environ(), "TOUR5_TEST_ACTIVATION="+name, "LISTEN_FDS=2", "LISTEN_FDNAMES=admin:clock")
+			cmd.ExtraFiles = files // Become descriptors 3 and 4 in the child
+			var output strings.Builder
+			cmd.Stdout, cmd.Stderr = &output, &output
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := net.DialTimeout("tcp", addrs[i], 5*time.Second)
+			if err != nil {
+				cmd.Wait()
+				t.Fatalf("dial %s: %v\n%s", addrs[i], err, output.String())
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			greeting, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				cmd.Wait()
+				t.Fatalf("reading from the child: %v\n%s", err, output.String())
+			}
+			if err := cmd.Wait(); err != nil {
+				t.Fatalf("child failed: %v\n%s", err, output.String())
+			}
+
+			if want := fmt.Sprintf("%s from %d\n", name, cmd.Process.Pid); greeting != want {
+				t.Errorf("child answered %q, want %q", greeting, want)
+			}
+		})
+	}
+}
+
+// activatedChild is the child side of TestActivationListener: it takes over the socket called name and
+// answers one connection with that name and its PID.
+func activatedChild(t *testing.T, name string) {
+	listener, err := activationListener(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if value, ok := os.LookupEnv(v); ok {
+			t.Errorf("%s=%q is still set, it would leak into child processes", v, value)
+		}
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "%s from %d\n", name, os.Getpid())
+}
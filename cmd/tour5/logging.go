@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// Structured logging: every record is a message plus key/value attributes, printed as text or JSON.
+// https://go.dev/blog/slog
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func parseLogFormat(s string) (string, error) {
+	switch format := strings.ToLower(s); format {
+	case "text", "json":
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid log format %q: must be text or json", s)
+	}
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil { // Accepts debug, info, warn, error (and offsets such as "info+2")
+		return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// client is what the server knows about one connection.
+type client struct {
+	id       uint64 // Sequential, so log lines of the same connection can be grouped
+	conn     net.Conn
+	clock    clock // The server's, so ages follow a fake clock in tests too
+	accepted time.Time
+	log      *slog.Logger // Already tagged with the connection ID and the remote address
+}
+
+func newClient(id uint64, conn net.Conn, clk clock) *client {
+	return &client{
+		id:       id,
+		conn:     conn,
+		clock:    clk,
+		accepted: clk.Now(),
+		log:      slog.With("conn", id, "remote", conn.RemoteAddr().String()),
+	}
+}
+
+// age is how long the connection has lived, as a log attribute.
+func (c *client) age() slog.Attr {
+	return slog.Duration("age", c.clock.Now().Sub(c.accepted).Round(time.Millisecond))
+}
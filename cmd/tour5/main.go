@@ -1,98 +1,492 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
-	"time"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 // Example below based on an exercise from Chapter 8 of "The Go Programming Language"
 // https://go.dev/tour/list
 func main() {
+	// "tour5 sntp host:port" is a small SNTP client instead of the server, see sntp.go
+	if len(os.Args) > 1 && os.Args[1] == "sntp" {
+		os.Exit(sntpClient(os.Args[2:]))
+	}
+
 	// https://go.dev/tour/concurrency/1
 	fmt.Println("Concurrency in Go...")
 
+	base, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
+	// Settings from the config file (-config) go on top of flags and environment. "base" is kept for SIGHUP reloads.
+	cfg, err := withConfigFile(base)
+	if err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
+
+	// From here on, every record (including the ones from the "log" package) goes through slog
+	slog.SetDefault(newLogger(os.Stderr, cfg.logFormat, cfg.logLevel))
+
+	// Listeners passed down by the previous process, when this one was started by a restart (SIGUSR2)
+	listeners, err := inheritListeners()
+	if err != nil {
+		fatal("Failed to inherit listeners", err)
+	}
+
 	// Go Routines
-	listener, err := net.Listen("tcp", ":8000")
+	listener, err := listeners.listen("main", func() (net.Listener, error) { return listen(cfg.addr, cfg.unixMode) })
 	if err != nil {
-		log.Fatalln("Failed to start TCP listener:", err) // Ends program, there is no reason for continuing if listening failed
+		fatal("Failed to start listener", err) // Ends program, there is no reason for continuing if listening failed
 	}
 
+	tlsCfg, err := newTLSConfig(cfg)
+	if err != nil {
+		fatal("Failed to set up TLS", err)
+	}
+	slog.Info("Listening", "addr", listener.Addr().String(), "tls", tlsCfg != nil, "mtls", cfg.tlsClientCA != "", "interval", cfg.interval, "align", cfg.align, "format", cfg.format.name, "tz", cfg.location.String())
+
 	// Channel that listens to OS signals
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGTERM) // Notifies "done" that an interrupt signal was sent (ending the server via terminal)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM) // Notifies "signals" that an interrupt signal was sent (ending the server via terminal)
+	signal.Notify(signals, syscall.SIGUSR2)               // Restart without downtime, see restart.go
+	signal.Notify(signals, syscall.SIGHUP)                // Reload the config file, see configfile.go
+
+	// A signal puts a single value on the channel, so only one receiver would ever wake up.
+	// A context, on the other hand, is cancelled once and every goroutine waiting on ctx.Done() sees it,
+	// because Done() returns a channel that gets closed (and receiving from a closed channel never blocks).
+	// WithCancelCause also records why it was cancelled, which ends up in the logs.
+	// https://go.dev/blog/context
+	// https://pkg.go.dev/context#WithCancelCause
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	srv := newServer(base, cfg, listener, systemClock{})
+	srv.listeners = listeners
+	srv.tls = tlsCfg // Connections are wrapped in TLS after accepting them, since a PROXY header (proxy.go) comes before TLS
 
-	// Go routine that ends the server, listens to "done" waiting for an interrupt signal
-	go endServer(done, listener)
+	// Optional HTTP listener for metrics and health checks, kept up until the very end so it can report the shutdown
+	if cfg.adminAddr != "" {
+		adminListener, err := listeners.listen("admin", func() (net.Listener, error) { return net.Listen("tcp", cfg.adminAddr) })
+		if err != nil {
+			fatal("Failed to start admin listener", err)
+		}
+		admin := &http.Server{Handler: srv.metrics.adminHandler()}
+		go func() {
+			if err := admin.Serve(adminListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Admin listener failed", "err", err)
+			}
+		}()
+		defer admin.Close()
+		slog.Info("Serving metrics", "url", "http://"+adminListener.Addr().String()+"/metrics")
+	}
+
+	// The only ticker of the server, shared by every connection
+	go srv.ticks.run(ctx)
+
+	// Optional HTTP front-ends (Server-Sent Events, WebSocket and a small page), they stop accepting as soon as shutdown starts
+	if cfg.httpAddr != "" {
+		httpListener, err := listeners.listen("http", func() (net.Listener, error) { return net.Listen("tcp", cfg.httpAddr) })
+		if err != nil {
+			fatal("Failed to start HTTP listener", err)
+		}
+		front := srv.serveHTTP(ctx, httpListener, tlsCfg)
+		defer front.Close()
+		context.AfterFunc(ctx, func() { front.Shutdown(context.Background()) })
+	}
 
-	serve(listener, done)
+	// Optional SNTP server on UDP, next to the TCP clock
+	if cfg.sntpAddr != "" {
+		sntpConn, err := listeners.listenPacket("sntp", func() (net.PacketConn, error) { return net.ListenPacket("udp", cfg.sntpAddr) })
+		if err != nil {
+			fatal("Failed to start SNTP listener", err)
+		}
+		go srv.serveSNTP(ctx, sntpConn)
+		slog.Info("Serving SNTP", "addr", sntpConn.LocalAddr().String())
+	}
+
+	// Optional JSON-RPC time service, see rpc.go
+	if cfg.rpcAddr != "" {
+		rpcListener, err := listeners.listen("rpc", func() (net.Listener, error) { return net.Listen("tcp", cfg.rpcAddr) })
+		if err != nil {
+			fatal("Failed to start RPC listener", err)
+		}
+		go srv.serveRPC(ctx, rpcListener)
+	}
+
+	// Go routine that ends the server, listens to "signals" waiting for an interrupt signal
+	go srv.endServer(signals, cancel)
+
+	// Everything is listening: if a previous process started this one, it can stop accepting now
+	listeners.notifyReady()
+
+	srv.serve(ctx)
+
+	drained, forced := srv.drain(cfg.shutdownTimeout)
+	slog.Info("Server stopped", "drained", drained, "forced", forced, "cause", context.Cause(ctx))
+}
+
+// server groups up everything the goroutines below need to share.
+type server struct {
+	// The running configuration. SIGHUP swaps it for a new one while handlers keep reading it,
+	// so it sits behind an atomic pointer: readers always see a whole config, never half of an update.
+	// https://pkg.go.dev/sync/atomic#Pointer
+	cfg  atomic.Pointer[config]
+	base config // Flags and environment only, the config file is applied on top of it on every reload
+
+	// Time for ticks, SNTP answers, rate limits and connection lifetimes comes from here, see clock.go.
+	// Write deadlines are the exception: net.Conn takes them on the real clock.
+	clock clock
+
+	listener  net.Listener
+	listeners *listenerSet // Raw listeners by name, handed to the new process on restart
+	ticks     *broadcaster
+	tls       *tls.Config // nil when TLS is disabled
+	limit     *connLimit
+	perIP     *ipLimiter
+	metrics   *metrics
+
+	// WaitGroup counts running handlers, so shutdown can wait for all of them.
+	// https://pkg.go.dev/sync#WaitGroup
+	wg sync.WaitGroup
+
+	// Live connections, so the ones still running after the shutdown deadline can be closed.
+	// A map is not safe for concurrent use, hence the mutex.
+	// https://go.dev/tour/concurrency/9
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool // Set by drain, after that no handler may join the WaitGroup
+
+	drained atomic.Int64  // Handlers that stopped because the server was shutting down
+	lastID  atomic.Uint64 // Last connection ID handed out
 }
 
-// Blocking function, will execute this loop endlessly till done sends a signal
-func serve(listener net.Listener, done chan os.Signal) {
+// newServer only needs a net.Listener and a clock, so anything implementing them can drive it:
+// the listeners of listener.go and restart.go here, or in-memory ones (net.Pipe) and a fake clock in a test.
+func newServer(base, cfg config, listener net.Listener, clk clock) *server {
+	s := &server{
+		base:     base,
+		clock:    clk,
+		listener: listener,
+		ticks:    newBroadcaster(&cfg, clk),
+		limit:    newConnLimit(cfg.maxConns),
+		perIP:    newIPLimiter(),
+		metrics:  newMetrics(),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.cfg.Store(&cfg)
+	return s
+}
+
+// config is the configuration in effect right now. It must not be modified, reload replaces it as a whole.
+func (s *server) config() *config {
+	return s.cfg.Load()
+}
+
+// Blocking function, will execute this loop endlessly till ctx is cancelled
+func (s *server) serve(ctx context.Context) {
+	s.metrics.accepting.Store(true)
+	defer s.metrics.accepting.Store(false)
+
 	for { // Endless loop
-		conn, err := listener.Accept()
+		conn, err := s.listener.Accept()
 		if err != nil {
 			select {
-				case <-done:
-					log.Println("Listener closed, connections loop exiting.")
-            		return 
-
-				// Default case basically is an alternative if none of the selected cases happen.
-				// The idea is to make our select non-blocking, since it is not just waiting for signals, and has an alternative to keep on our for loop.
-				// https://go.dev/tour/concurrency/6
-				default: 
-					log.Println("Error accepting connection! Error message: ", err)
-					continue // Moves to the next iteration, without executing what comes next in this iteration
+			case <-ctx.Done():
+				slog.Info("Listener closed, connections loop exiting", "cause", context.Cause(ctx))
+				return
+
+			// Default case basically is an alternative if none of the selected cases happen.
+			// The idea is to make our select non-blocking, since it is not just waiting for signals, and has an alternative to keep on our for loop.
+			// https://go.dev/tour/concurrency/6
+			default:
+				slog.Error("Error accepting connection", "err", err)
+				s.metrics.acceptErrors.Add(1)
+				continue // Moves to the next iteration, without executing what comes next in this iteration
 			}
 		}
-		log.Println("Connection accepted!")
-		go handleConn(conn, done) // Handling connections concurrently with a Go Routine
+		c := newClient(s.lastID.Add(1), conn, s.clock)
+		c.log.Info("Connection accepted")
+		s.metrics.totalConns.Add(1)
+		s.track(conn)
+
+		// Handling connections concurrently with a Go Routine, counted by the WaitGroup
+		s.wg.Go(func() {
+			if s.prepare(c) {
+				s.serveClient(ctx, c, s.handleConn)
+			}
+		})
 	}
 }
 
-func handleConn(conn net.Conn, done chan os.Signal) {
-	defer conn.Close() // Closes the connection at the end of the function execution
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+// serveClient takes an accepted connection through the TLS handshake and the connection limit, then hands it to handle:
+// handleConn for the clock stream, handleRPC for the time service.
+// The client was already screened (prepare, or serveStream for HTTP), its per-IP slot is given back here.
+func (s *server) serveClient(ctx context.Context, c *client, handle func(context.Context, *client) string) {
+	defer s.perIP.release(c.conn.RemoteAddr())
+	if err := s.handshake(c); err != nil {
+		c.log.Warn("TLS handshake failed", "err", err, c.age())
+		s.metrics.disconnect(reasonTLSHandshake)
+		s.untrack(c.conn)
+		return
+	}
+	if !s.admit(ctx, c) {
+		s.untrack(c.conn)
+		return
+	}
+	defer s.limit.release()
 
-	for {
-		_, err := io.WriteString(conn, time.Now().Format("15:04:05\n"))
-		if err != nil {
-			log.Println("Client disconnected. Error message: ", err)
-			return // Ending Go Routine
+	start := s.clock.Now()
+	s.metrics.connOpened()
+	reason := handle(ctx, c)
+	s.metrics.connClosed(reason, s.clock.Now().Sub(start))
+	c.log.Info("Connection closed", "reason", reason, c.age())
+}
+
+// handleConn streams ticks to conn until something ends the connection, and returns the reason why.
+func (s *server) handleConn(ctx context.Context, c *client) (reason string) {
+	conn := c.conn
+	defer s.untrack(conn) // Closes the connection at the end of the function execution
+
+	sub := s.ticks.subscribe()
+	if sub == nil {
+		return reasonShutdown // The broadcaster already stopped, the server is shutting down
+	}
+	defer s.ticks.unsubscribe(sub)
+
+	// Reading happens in another goroutine, the commands arrive through "lines"
+	sess := newSession(*s.config())
+	lines := make(chan string)
+	stop := make(chan struct{})
+	defer close(stop)
+	go readLines(conn, lines, stop)
+
+	// Every write gets a deadline, so a client that stopped reading cannot pin this goroutine forever
+	// https://pkg.go.dev/net#Conn (SetWriteDeadline)
+	// It returns the disconnect reason when the write fails, or an empty string.
+	send := func(text string) string {
+		writeTimeout := s.config().writeTimeout
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		n, err := io.WriteString(conn, text)
+		s.metrics.bytesWritten.Add(int64(n))
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			c.log.Warn("Evicting client, write took too long", "write_timeout", writeTimeout, c.age())
+			return reasonWriteTimeout
+		case err != nil:
+			c.log.Info("Client disconnected", "err", err, c.age())
+			return reasonClientGone
 		}
+		return ""
+	}
+	sendTick := func(t tick) string {
+		if reason := send(sess.line(t)); reason != "" {
+			return reason
+		}
+		s.metrics.ticksWritten.Add(1)
+		return ""
+	}
 
+	// The first tick is sent right away, instead of making the client wait for the next broadcast
+	if reason := sendTick(s.ticks.now()); reason != "" {
+		return reason // Ending Go Routine
+	}
+
+	// A single timer, armed for the soonest pending ALARM or TIMER and re-armed whenever that changes.
+	// Its channel stays nil while nothing is pending, which keeps its case below from ever firing.
+	// Stopping it when the handler returns is all it takes to cancel everything pending: the rest lives in sess.
+	var reminder timer
+	var reminderC <-chan time.Time
+	rearm := func() {
+		if reminder != nil {
+			reminder.Stop()
+			reminder, reminderC = nil, nil
+		}
+		if due, ok := sess.nextDue(); ok {
+			reminder = s.clock.NewTimer(due.Sub(s.clock.Now()))
+			reminderC = reminder.C()
+		}
+	}
+	defer func() {
+		if reminder != nil {
+			reminder.Stop()
+		}
+	}()
+
+	for {
 		// Select
 		// Is similar to a "switch", but each case specifies a communication operation (send or receive) on a channel.
 		// Without a "default" case, select blocks the goroutine until one of the cases is ready to proceed.
 		// https://go.dev/tour/concurrency/5
 		select {
 
-		case <-done:
-			// Triggered if a value is received from "done" (or if it is closed), ends active connections.
-			log.Println("Stopping handler via signal.")
+		case <-ctx.Done():
+			// Triggered when the context is cancelled, every active handler receives it at the same time.
+			c.log.Info("Stopping handler via shutdown", "cause", context.Cause(ctx), c.age())
+			s.drained.Add(1)
+			return reasonShutdown
+
+		case t := <-sub.ticks:
+			// The broadcaster sends a tick after every interval (1 second by default).
+			// Ticks it had to replace because this handler was still busy count as lag.
+			maxLag := s.config().maxLag
+			if lag := sub.missed.Swap(0); maxLag > 0 && lag > int64(maxLag) {
+				c.log.Warn("Evicting client, fell behind", "lag", lag, "max_lag", maxLag, c.age())
+				return reasonLagging
+			}
+			if sess.paused {
+				continue
+			}
+			if reason := sendTick(t); reason != "" {
+				return reason
+			}
+
+		case <-reminderC:
+			// Checked against the clock instead of trusting the timer: if the wall clock was set back, an ALARM
+			// is not due yet and rearm simply waits for the rest of it
+			for _, notification := range sess.due(s.clock.Now()) {
+				if reason := send(notification); reason != "" {
+					return reason
+				}
+			}
+			rearm()
+
+		case line, ok := <-lines:
+			if !ok {
+				// The client stopped writing (e.g. "nc" after stdin ends), but it may still be reading.
+				// Receiving from a nil channel blocks forever, so this case simply never fires again.
+				// https://go.dev/ref/spec#Receive_operator
+				lines = nil
+				continue
+			}
+			reply, quit := sess.handle(line, s.clock.Now())
+			c.log.Debug("Command received", "line", line, "reply", strings.TrimSpace(reply))
+			rearm()
+			if reply != "" {
+				if reason := send(reply); reason != "" {
+					return reason
+				}
+			}
+			if quit {
+				c.log.Info("Client quit", c.age())
+				return reasonQuit
+			}
+		}
+	}
+}
+
+func (s *server) endServer(signals chan os.Signal, cancel context.CancelCauseFunc) {
+	for sig := range signals { // Go routine blocked, waiting signals
+		if sig == syscall.SIGHUP {
+			slog.Info("Reloading configuration", "signal", sig.String())
+			s.reload()
+			continue
+		}
+		if sig == syscall.SIGUSR2 {
+			slog.Info("Restarting, handing listeners to a new process", "signal", sig.String())
+			pid, err := s.listeners.handOff()
+			if err != nil {
+				slog.Error("Restart failed, still serving", "err", err)
+				continue
+			}
+			// The new process is accepting, from here on this one just drains like in a regular shutdown
+			s.listeners.keepSocketFiles()
+			cancel(fmt.Errorf("restarted as process %d", pid))
+			s.listener.Close()
 			return
+		}
+
+		slog.Info("Shutting down server", "signal", sig.String())
+		cancel(fmt.Errorf("received signal %v", sig)) // Tells every handler to stop, and why
+		s.listener.Close()                            // Freeing the port (8000 by default)
+		return
+	}
+}
+
+// drain waits for the handlers to finish, up to timeout.
+// Connections still open after that are closed, which also unblocks handlers stuck in a write.
+func (s *server) drain(timeout time.Duration) (drained, forced int) {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
 
-		case <- ticker.C:
-			// Channel that sends a signal after 1 second.
-			// This acts as a timeout or wait and just moves to the next execution of our loop. 
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		s.mu.Lock()
+		forced = len(s.conns)
+		for conn := range s.conns {
+			conn.Close()
 		}
+		s.mu.Unlock()
+		slog.Warn("Shutdown deadline exceeded, closing remaining connections", "timeout", timeout, "remaining", forced)
+		<-finished
 	}
+	return int(s.drained.Load()), forced
+}
+
+// fatal logs err and ends the program, the slog version of log.Fatalln.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// enter adds a handler started outside serve (such as an HTTP stream) to the WaitGroup.
+// It fails once drain started: calling Add while Wait may be returning is a misuse of WaitGroup.
+func (s *server) enter() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *server) track(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = struct{}{}
+}
+
+// replace swaps the connection of c for conn, a wrapper around it (TLS, PROXY header), in the tracked set too.
+func (s *server) replace(c *client, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c.conn)
+	s.conns[conn] = struct{}{}
+	c.conn = conn
 }
 
-func endServer(done chan os.Signal, listener net.Listener) {
-	<-done // Go routine blocked, waiting signal
-	log.Println("Shutting down server...")
-	listener.Close() // Freeing 8000
+func (s *server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	conn.Close()
 }
 
 // Interesting resources (I plan to deep dive them later on and bring more examples and thoughts to the table):
 // - https://stackoverflow.com/questions/48638663/what-is-relationship-between-goroutine-and-thread-in-kernel-and-user-state
 // - https://www.youtube.com/watch?v=KBZlN0izeiY&t=536s
-// - https://www.reddit.com/r/golang/comments/117a4x7/how_can_goroutines_be_more_scalable_than_kernel/
\ No newline at end of file
+// - https://www.reddit.com/r/golang/comments/117a4x7/how_can_goroutines_be_more_scalable_than_kernel/
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Why a connection ended, used as the "reason" label of the disconnect counter.
+const (
+	reasonShutdown     = "shutdown"      // The server is shutting down
+	reasonQuit         = "quit"          // The client sent QUIT
+	reasonClientGone   = "client_gone"   // A write failed, usually because the client went away
+	reasonWriteTimeout = "write_timeout" // A write took longer than -write-timeout
+	reasonLagging      = "lagging"       // The client fell behind by more than -max-lag ticks
+	reasonTLSHandshake = "tls_handshake" // The TLS handshake failed
+
+	// Connections rejected before being served, also counted by the rejection counter
+	reasonServerFull  = "server_full"  // Rejected because of -max-conns
+	reasonDenied      = "denied"       // Rejected by the allow/deny lists
+	reasonRateLimited = "rate_limited" // Rejected by -ip-rate or -max-conns-per-ip
+	reasonProxyHeader = "proxy_header" // A trusted upstream sent no valid PROXY header
+)
+
+// Upper bounds (in seconds) of the connection lifetime histogram buckets
+var lifetimeBuckets = []float64{1, 5, 15, 60, 300, 900, 3600}
+
+// metrics counts what the server does. Plain counters are atomics, so the hot path never takes a lock;
+// the labeled counter and the histogram need a mutex.
+// https://pkg.go.dev/sync/atomic
+type metrics struct {
+	activeConns  atomic.Int64
+	totalConns   atomic.Int64
+	bytesWritten atomic.Int64
+	ticksWritten atomic.Int64
+	acceptErrors atomic.Int64
+	sntpRequests atomic.Int64
+	rpcCalls     atomic.Int64
+	accepting    atomic.Bool // Whether the accept loop is running, reported by /healthz
+
+	mu              sync.Mutex
+	disconnects     map[string]int64
+	rejections      map[string]int64
+	lifetimeCounts  []int64 // One per bucket, plus the last one for +Inf
+	lifetimeSum     float64
+	lifetimeObserve int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		disconnects:    make(map[string]int64),
+		rejections:     make(map[string]int64),
+		lifetimeCounts: make([]int64, len(lifetimeBuckets)+1),
+	}
+}
+
+func (m *metrics) connOpened() {
+	m.activeConns.Add(1)
+}
+
+// connClosed records a served connection that ended after living for lifetime.
+func (m *metrics) connClosed(reason string, lifetime time.Duration) {
+	m.activeConns.Add(-1)
+	m.disconnect(reason)
+
+	seconds := lifetime.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, _ := slices.BinarySearch(lifetimeBuckets, seconds) // First bucket whose bound is >= seconds
+	m.lifetimeCounts[i]++
+	m.lifetimeSum += seconds
+	m.lifetimeObserve++
+}
+
+func (m *metrics) disconnect(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.disconnects[reason]++
+}
+
+// reject records a connection turned away before being served. It ends there, so it is a disconnect too.
+func (m *metrics) reject(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejections[reason]++
+	m.disconnects[reason]++
+}
+
+// writeTo writes every metric in the Prometheus text format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+func (m *metrics) writeTo(w io.Writer) {
+	gauge := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+
+	gauge("clock_connections_active", "Connections currently being served.", m.activeConns.Load())
+	counter("clock_connections_total", "Connections accepted since the server started.", m.totalConns.Load())
+	counter("clock_bytes_written_total", "Bytes written to clients.", m.bytesWritten.Load())
+	counter("clock_ticks_written_total", "Tick lines written to clients.", m.ticksWritten.Load())
+	counter("clock_accept_errors_total", "Errors returned by the listener while accepting.", m.acceptErrors.Load())
+	counter("clock_sntp_requests_total", "SNTP requests answered.", m.sntpRequests.Load())
+	counter("clock_rpc_calls_total", "JSON-RPC calls answered.", m.rpcCalls.Load())
+
+	// Runtime numbers, named like the ones of the official Prometheus client so dashboards and tools (cmd/clockload) can share them.
+	// ReadMemStats briefly stops the world, which is fine at the pace of a scrape.
+	// https://pkg.go.dev/runtime#MemStats
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gauge("go_goroutines", "Number of goroutines that currently exist.", int64(runtime.NumGoroutine()))
+	gauge("go_memstats_alloc_bytes", "Bytes of allocated heap objects.", int64(mem.HeapAlloc))
+	gauge("go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans.", int64(mem.HeapInuse))
+	gauge("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", int64(mem.Sys))
+	counter("go_memstats_gc_completed_total", "Completed garbage collection cycles.", int64(mem.NumGC))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP clock_disconnects_total Connections that ended, by reason.")
+	fmt.Fprintln(w, "# TYPE clock_disconnects_total counter")
+	for _, reason := range slices.Sorted(maps.Keys(m.disconnects)) { // Sorted, so the output is stable between scrapes
+		fmt.Fprintf(w, "clock_disconnects_total{reason=%q} %d\n", reason, m.disconnects[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP clock_rejections_total Connections turned away before being served, by reason.")
+	fmt.Fprintln(w, "# TYPE clock_rejections_total counter")
+	for _, reason := range slices.Sorted(maps.Keys(m.rejections)) {
+		fmt.Fprintf(w, "clock_rejections_total{reason=%q} %d\n", reason, m.rejections[reason])
+	}
+
+	// Histogram buckets are cumulative: each one also counts everything in the buckets before it.
+	fmt.Fprintln(w, "# HELP clock_connection_duration_seconds How long served connections lived.")
+	fmt.Fprintln(w, "# TYPE clock_connection_duration_seconds histogram")
+	var cumulative int64
+	for i, bound := range lifetimeBuckets {
+		cumulative += m.lifetimeCounts[i]
+		fmt.Fprintf(w, "clock_connection_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	cumulative += m.lifetimeCounts[len(lifetimeBuckets)]
+	fmt.Fprintf(w, "clock_connection_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "clock_connection_duration_seconds_sum %g\n", m.lifetimeSum)
+	fmt.Fprintf(w, "clock_connection_duration_seconds_count %d\n", m.lifetimeObserve)
+}
+
+// adminHandler serves /metrics and /healthz.
+// https://pkg.go.dev/net/http#ServeMux
+func (m *metrics) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.writeTo(w)
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !m.accepting.Load() {
+			http.Error(w, "not accepting connections", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Line-based protocol clients can use to change their own stream:
+//
+//	TZ <zone>        switches the time zone, e.g. "TZ America/Sao_Paulo"
+//	FORMAT <format>  switches the format (same presets and layouts as the -format flag)
+//	PAUSE            stops the ticks, commands keep working
+//	RESUME           starts the ticks again
+//	QUIT             closes the connection
+//
+// plus the timing commands ALARM, TIMER, LIST, CANCEL and STOPWATCH (see alarms.go).
+// Commands are case-insensitive. Every command gets back a line starting with "OK" or "ERR".
+const maxCommandLength = 1024
+
+// session is the state of one connection that commands can change.
+type session struct {
+	location *time.Location
+	format   timeFormat
+	paused   bool
+	custom   bool // Whether TZ or FORMAT changed anything, otherwise the line formatted by the broadcaster is used as is
+
+	reminders []reminder // Pending alarms and timers, soonest first
+	lastID    int        // Last id handed to a reminder, ids are never reused within a connection
+	watch     stopwatch
+}
+
+func newSession(cfg config) *session {
+	return &session{location: cfg.location, format: cfg.format}
+}
+
+// line is what gets written to the client for t.
+func (s *session) line(t tick) string {
+	if !s.custom {
+		return t.line
+	}
+	return s.format.format(t.time.In(s.location)) + "\n"
+}
+
+// handle runs a single command line received at now and returns the reply to send back (empty for blank lines)
+// and whether the client asked to close the connection.
+func (s *session) handle(line string, now time.Time) (reply string, quit bool) {
+	line = strings.TrimSpace(line) // Also drops the "\r" sent by telnet-like clients
+	if line == "" {
+		return "", false
+	}
+
+	// strings.Cut splits on the first space only, so layouts such as "Mon Jan 2 15:04" arrive intact.
+	// https://pkg.go.dev/strings#Cut
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch strings.ToUpper(name) {
+	case "TZ":
+		if arg == "" {
+			return "ERR TZ needs a time zone, e.g. TZ America/Sao_Paulo\n", false
+		}
+		location, err := time.LoadLocation(arg)
+		if err != nil {
+			return fmt.Sprintf("ERR unknown time zone %q\n", arg), false
+		}
+		s.location = location
+		s.custom = true
+		return fmt.Sprintf("OK TZ %s\n", location), false
+
+	case "FORMAT":
+		format, err := parseFormat(arg)
+		if err != nil {
+			return fmt.Sprintf("ERR %v\n", err), false
+		}
+		s.format = format
+		s.custom = true
+		return fmt.Sprintf("OK FORMAT %s\n", format.name), false
+
+	case "PAUSE":
+		s.paused = true
+		return "OK PAUSE\n", false
+
+	case "RESUME":
+		s.paused = false
+		return "OK RESUME\n", false
+
+	case "ALARM":
+		return s.alarm(arg, now), false
+
+	case "TIMER":
+		return s.timer(arg, now), false
+
+	case "LIST":
+		return s.list(now), false
+
+	case "CANCEL":
+		return s.cancel(arg), false
+
+	case "STOPWATCH":
+		return s.stopwatch(arg, now), false
+
+	case "QUIT":
+		return "OK QUIT\n", true
+
+	case "PROXY":
+		// A PROXY protocol header from an address not in -proxy-trusted, read as a command: someone trying
+		// to pass as another client, or a balancer missing from the list. Either way, not a client to keep.
+		return "ERR PROXY header not accepted from this address\n", true
+
+	default:
+		return fmt.Sprintf("ERR unknown command %q\n", name), false
+	}
+}
+
+// readLines sends every line the client writes to "lines", closing it once the client stops writing.
+// It runs in its own goroutine so reading never blocks the ticker loop in handleConn.
+// "stop" is closed by the handler when it returns, so this goroutine never gets stuck on a send nobody will receive.
+func readLines(conn net.Conn, lines chan<- string, stop <-chan struct{}) {
+	defer close(lines)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64), maxCommandLength) // Longer lines end the scan with bufio.ErrTooLong
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSession(t *testing.T) *session {
+	t.Helper()
+	format, err := parseFormat("clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSession(config{location: time.UTC, format: format})
+}
+
+func TestSessionHandle(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string // Sent in order, only the reply to the last one is checked
+		reply string   // Prefix of the expected reply
+		quit  bool
+
+		// State after the last line
+		location string
+		format   string
+		paused   bool
+		custom   bool
+		pending  int // Alarms and timers
+	}{
+		{name: "blank line", lines: []string{""}, reply: "", location: "UTC", format: "clock"},
+		{name: "spaces only", lines: []string{"   \r"}, reply: "", location: "UTC", format: "clock"},
+		{name: "time zone", lines: []string{"TZ Asia/Tokyo"}, reply: "OK TZ Asia/Tokyo", location: "Asia/Tokyo", format: "clock", custom: true},
+		{name: "lower case command", lines: []string{"tz America/Sao_Paulo"}, reply: "OK TZ America/Sao_Paulo", location: "America/Sao_Paulo", format: "clock", custom: true},
+		{name: "telnet line ending", lines: []string{"TZ Europe/Paris\r"}, reply: "OK TZ Europe/Paris", location: "Europe/Paris", format: "clock", custom: true},
+		{name: "time zone missing", lines: []string{"TZ"}, reply: "ERR TZ needs a time zone", location: "UTC", format: "clock"},
+		{name: "unknown time zone", lines: []string{"TZ Mars/Olympus"}, reply: `ERR unknown time zone "Mars/Olympus"`, location: "UTC", format: "clock"},
+		{name: "bad zone keeps the previous one", lines: []string{"TZ Asia/Tokyo", "TZ Nowhere"}, reply: "ERR unknown time zone", location: "Asia/Tokyo", format: "clock", custom: true},
+		{name: "format preset", lines: []string{"FORMAT rfc3339"}, reply: "OK FORMAT rfc3339", location: "UTC", format: "rfc3339", custom: true},
+		{name: "format preset in upper case", lines: []string{"format KITCHEN"}, reply: "OK FORMAT kitchen", location: "UTC", format: "kitchen", custom: true},
+		{name: "format layout with spaces", lines: []string{"FORMAT Mon Jan 2 15:04"}, reply: "OK FORMAT Mon Jan 2 15:04", location: "UTC", format: "Mon Jan 2 15:04", custom: true},
+		{name: "format without time fields", lines: []string{"FORMAT hello"}, reply: `ERR invalid format "hello"`, location: "UTC", format: "clock"},
+		{name: "format missing", lines: []string{"FORMAT"}, reply: `ERR invalid format ""`, location: "UTC", format: "clock"},
+		{name: "pause", lines: []string{"PAUSE"}, reply: "OK PAUSE", location: "UTC", format: "clock", paused: true},
+		{name: "resume", lines: []string{"PAUSE", "Resume"}, reply: "OK RESUME", location: "UTC", format: "clock"},
+		{name: "quit", lines: []string{"QUIT"}, reply: "OK QUIT", quit: true, location: "UTC", format: "clock"},
+		{name: "quit in lower case", lines: []string{"quit"}, reply: "OK QUIT", quit: true, location: "UTC", format: "clock"},
+		{name: "proxy header from an untrusted peer", lines: []string{"PROXY TCP4 1.2.3.4 5.6.7.8 1 2"}, reply: "ERR PROXY header not accepted", quit: true, location: "UTC", format: "clock"},
+		{name: "unknown command", lines: []string{"HELLO world"}, reply: `ERR unknown command "HELLO"`, location: "UTC", format: "clock"},
+
+		// Timing commands, all at noon UTC (alarms.go)
+		{name: "alarm later today", lines: []string{"ALARM 15:30"}, reply: "OK ALARM #1 at 2026-10-18T15:30:00Z (in 3h30m0s)\n", location: "UTC", format: "clock", pending: 1},
+		{name: "alarm tomorrow with a label", lines: []string{"alarm 09:15:30 standup"}, reply: "OK ALARM #1 at 2026-10-19T09:15:30Z (in 21h15m30s)\n", location: "UTC", format: "clock", pending: 1},
+		{name: "alarm in the session's time zone", lines: []string{"TZ Asia/Tokyo", "ALARM 22:00"}, reply: "OK ALARM #1 at 2026-10-18T22:00:00+09:00 (in 1h0m0s)\n", location: "Asia/Tokyo", format: "clock", custom: true, pending: 1},
+		{name: "alarm past midnight", lines: []string{"ALARM 24:00"}, reply: "ERR ALARM needs a time of day", location: "UTC", format: "clock"},
+		{name: "alarm without a time", lines: []string{"ALARM"}, reply: "ERR ALARM needs a time of day", location: "UTC", format: "clock"},
+		{name: "alarm with a duration", lines: []string{"ALARM 5m"}, reply: "ERR ALARM needs a time of day", location: "UTC", format: "clock"},
+		{name: "timer", lines: []string{"TIMER 90s tea"}, reply: "OK TIMER #1 1m30s\n", location: "UTC", format: "clock", pending: 1},
+		{name: "longest timer", lines: []string{"TIMER 24h"}, reply: "OK TIMER #1 24h0m0s\n", location: "UTC", format: "clock", pending: 1},
+		{name: "timer too long", lines: []string{"TIMER 24h1s"}, reply: "ERR TIMER is limited to 24h0m0s, use ALARM instead\n", location: "UTC", format: "clock"},
+		{name: "timer of zero", lines: []string{"TIMER 0s"}, reply: "ERR TIMER needs a positive duration", location: "UTC", format: "clock"},
+		{name: "timer without a unit", lines: []string{"TIMER 5"}, reply: "ERR TIMER needs a positive duration", location: "UTC", format: "clock"},
+		{name: "list nothing", lines: []string{"LIST"}, reply: "OK LIST 0\n", location: "UTC", format: "clock"},
+		{name: "list soonest first", lines: []string{"ALARM 13:00", "TIMER 5m tea", "LIST"}, reply: "OK LIST 2 #2 TIMER 5m0s tea in 5m0s; #1 ALARM 13:00 in 1h0m0s\n", location: "UTC", format: "clock", pending: 2},
+		{name: "cancel", lines: []string{"TIMER 5m", "TIMER 10m", "CANCEL 1"}, reply: "OK CANCEL #1 TIMER 5m0s\n", location: "UTC", format: "clock", pending: 1},
+		{name: "cancel with a hash", lines: []string{"ALARM 13:00", "cancel #1"}, reply: "OK CANCEL #1 ALARM 13:00\n", location: "UTC", format: "clock"},
+		{name: "cancel twice", lines: []string{"TIMER 5m", "CANCEL 1", "CANCEL 1"}, reply: "ERR nothing pending with id 1\n", location: "UTC", format: "clock"},
+		{name: "ids are not reused", lines: []string{"TIMER 5m", "CANCEL 1", "TIMER 5m"}, reply: "OK TIMER #2 5m0s\n", location: "UTC", format: "clock", pending: 1},
+		{name: "cancel without an id", lines: []string{"CANCEL"}, reply: "ERR CANCEL needs the id shown by LIST", location: "UTC", format: "clock"},
+		{name: "cancel with a bad id", lines: []string{"CANCEL tea"}, reply: "ERR CANCEL needs the id shown by LIST", location: "UTC", format: "clock"},
+		{name: "pending limit", lines: append(slices.Repeat([]string{"TIMER 1m"}, maxPending), "ALARM 13:00"), reply: "ERR too many alarms and timers pending (max 16), CANCEL one first\n", location: "UTC", format: "clock", pending: maxPending},
+		{name: "room again after a cancel", lines: append(slices.Repeat([]string{"TIMER 1m"}, maxPending), "CANCEL 3", "TIMER 1m"), reply: "OK TIMER #17 1m0s\n", location: "UTC", format: "clock", pending: maxPending},
+		{name: "stopwatch start", lines: []string{"STOPWATCH start"}, reply: "OK STOPWATCH started\n", location: "UTC", format: "clock"},
+		{name: "stopwatch lap", lines: []string{"STOPWATCH start", "STOPWATCH LAP"}, reply: "OK STOPWATCH lap 1 0s (total 0s)\n", location: "UTC", format: "clock"},
+		{name: "stopwatch stop", lines: []string{"STOPWATCH start", "STOPWATCH lap", "STOPWATCH stop"}, reply: "OK STOPWATCH stopped 0s (1 laps)\n", location: "UTC", format: "clock"},
+		{name: "stopwatch lap before start", lines: []string{"STOPWATCH lap"}, reply: "ERR STOPWATCH is not running, STOPWATCH start first\n", location: "UTC", format: "clock"},
+		{name: "stopwatch stopped twice", lines: []string{"STOPWATCH start", "STOPWATCH stop", "STOPWATCH stop"}, reply: "ERR STOPWATCH is not running\n", location: "UTC", format: "clock"},
+		{name: "stopwatch without an action", lines: []string{"STOPWATCH"}, reply: "ERR STOPWATCH needs start, lap or stop\n", location: "UTC", format: "clock"},
+	}
+
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := testSession(t)
+			var reply string
+			var quit bool
+			for _, line := range tt.lines {
+				reply, quit = sess.handle(line, now)
+			}
+
+			if tt.reply == "" && reply != "" {
+				t.Errorf("reply = %q, want none", reply)
+			}
+			if !strings.HasPrefix(reply, tt.reply) {
+				t.Errorf("reply = %q, want it to start with %q", reply, tt.reply)
+			}
+			if reply != "" && !strings.HasSuffix(reply, "\n") {
+				t.Errorf("reply = %q, want a trailing newline", reply)
+			}
+			if quit != tt.quit {
+				t.Errorf("quit = %v, want %v", quit, tt.quit)
+			}
+			if got := sess.location.String(); got != tt.location {
+				t.Errorf("location = %q, want %q", got, tt.location)
+			}
+			if sess.format.name != tt.format {
+				t.Errorf("format = %q, want %q", sess.format.name, tt.format)
+			}
+			if sess.paused != tt.paused {
+				t.Errorf("paused = %v, want %v", sess.paused, tt.paused)
+			}
+			if sess.custom != tt.custom {
+				t.Errorf("custom = %v, want %v", sess.custom, tt.custom)
+			}
+			if len(sess.reminders) != tt.pending {
+				t.Errorf("%d alarms and timers pending, want %d", len(sess.reminders), tt.pending)
+			}
+		})
+	}
+}
+
+func TestSessionLine(t *testing.T) {
+	at := time.Date(2026, time.October, 18, 12, 30, 45, 0, time.UTC)
+	broadcast := tick{time: at, line: "12:30:45\n"}
+
+	sess := testSession(t)
+	if got := sess.line(broadcast); got != "12:30:45\n" {
+		t.Errorf("default session line = %q, want the broadcast line", got)
+	}
+
+	sess.handle("TZ Asia/Tokyo", at)
+	if got := sess.line(broadcast); got != "21:30:45\n" {
+		t.Errorf("line in Asia/Tokyo = %q, want %q", got, "21:30:45\n")
+	}
+
+	sess.handle("FORMAT unix", at)
+	if got, want := sess.line(broadcast), "1792326645\n"; got != want {
+		t.Errorf("unix line = %q, want %q", got, want)
+	}
+}
+
+func TestReadLinesMaxCommandLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{name: "short lines", input: "TZ UTC\nPAUSE\n", want: []string{"TZ UTC", "PAUSE"}},
+		// The newline counts towards the scanner buffer, so the longest command is one byte shorter than the limit
+		{name: "longest line", input: strings.Repeat("a", maxCommandLength-1) + "\n", want: []string{strings.Repeat("a", maxCommandLength-1)}},
+		{name: "too long ends reading", input: "PAUSE\n" + strings.Repeat("a", maxCommandLength) + "\nRESUME\n", want: []string{"PAUSE"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write([]byte(tt.input))
+				client.Close()
+			}()
+
+			lines := make(chan string)
+			stop := make(chan struct{})
+			defer close(stop)
+			go readLines(server, lines, stop)
+
+			var got []string
+			for line := range lines {
+				got = append(got, line)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("lines = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
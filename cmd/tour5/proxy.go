@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Behind a TCP load balancer every connection comes from the balancer's address. The PROXY protocol fixes that:
+// the balancer sends one header with the real client address before any byte of the client itself.
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+//
+// Anybody could send such a header, so it is only read from the addresses in -proxy-trusted, and those must send one.
+// Everybody else is served directly, by their own address; a header sent by them reaches the command parser,
+// which refuses it (see protocol.go).
+
+// Signature that starts every version 2 (binary) header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyV1MaxLength = 107 // Longest possible version 1 (text) header, "\r\n" included
+
+// proxyConn is a connection whose first bytes were a PROXY header. Reads go through the bufio.Reader
+// used to parse it, since it may already hold what the client sent right after (e.g. a TLS ClientHello).
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr // The client as told by the header
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+
+// prepare runs on a connection accepted by the main listener, before serveClient:
+// it reads the PROXY header when the peer is a trusted balancer, screens the client (see filter.go),
+// then wraps the connection in TLS when enabled.
+// All of it happens here, off the accept loop, since a header may take a while to arrive.
+// Screening comes before TLS so a rejected client gets its "ERR" line in plain text, without paying for a handshake first.
+// When it returns true the connection holds a per-IP slot, which serveClient gives back.
+func (s *server) prepare(c *client) bool {
+	cfg := s.config()
+	if ip, ok := remoteIP(c.conn.RemoteAddr()); ok && len(cfg.proxyTrusted) > 0 && containsAddr(cfg.proxyTrusted, ip) {
+		conn, err := readProxyHeader(c.conn, cfg.writeTimeout)
+		if err != nil {
+			c.log.Warn("Invalid PROXY header from trusted upstream", "err", err, c.age())
+			s.metrics.reject(reasonProxyHeader)
+			s.untrack(c.conn)
+			return false
+		}
+		s.replace(c, conn)
+		c.log = slog.With("conn", c.id, "remote", conn.RemoteAddr().String(), "upstream", ip.String())
+		c.log.Debug("PROXY header read")
+	}
+	if !s.screen(c) {
+		s.untrack(c.conn)
+		return false
+	}
+	if s.tls != nil {
+		s.replace(c, tls.Server(c.conn, s.tls)) // No I/O yet, the handshake happens in serveClient
+	}
+	return true
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a version 1 or 2 header from conn, giving up after timeout.
+// Headers that do not carry a TCP client address (LOCAL health checks, UNKNOWN, Unix sockets) keep the balancer's address.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReaderSize(conn, 256)         // Plenty for a header, what is left is read through proxyConn
+	start, err := r.Peek(len(proxyV2Signature)) // Shorter than any valid header of either version
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		remote, err = readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, err = readProxyV1(r)
+	default:
+		return nil, errors.New("connection does not start with a PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <src port> <dst port>\r\n" (or TCP6, or "PROXY UNKNOWN ...").
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > proxyV1MaxLength {
+		return nil, errors.New("v1 header too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header does not end with CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil // Rest of the line is meant to be ignored
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil || src.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+// readProxyV2 parses the binary header: signature, version and command, family and protocol,
+// length of what follows, then the addresses (and optional TLVs, skipped here).
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	version, command := header[12]>>4, header[12]&0x0f
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version %d", version)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: the balancer talking for itself, e.g. a health check
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown v2 command %#x", command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4: source and destination addresses (4 bytes each), then ports (2 bytes each)
+		if len(body) < 12 {
+			return nil, errors.New("v2 header too short for IPv4 addresses")
+		}
+		src := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x21: // TCP over IPv6: same layout with 16-byte addresses
+		if len(body) < 36 {
+			return nil, errors.New("v2 header too short for IPv6 addresses")
+		}
+		src := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[32:34]))), nil
+	default: // UNSPEC, UDP or Unix sockets: nothing this server can use
+		return nil, nil
+	}
+}
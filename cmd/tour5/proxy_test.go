@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a version 2 header: command 0x0 (LOCAL) or 0x1 (PROXY), family 0x11 (TCP over IPv4)
+// or 0x21 (TCP over IPv6), then the addresses and ports.
+func proxyV2(command, family byte, src, dst string, srcPort, dstPort uint16) string {
+	var body []byte
+	body = append(body, netip.MustParseAddr(src).AsSlice()...)
+	body = append(body, netip.MustParseAddr(dst).AsSlice()...)
+	body = binary.BigEndian.AppendUint16(body, srcPort)
+	body = binary.BigEndian.AppendUint16(body, dstPort)
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return string(append(header, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := proxyV2(0x1, 0x11, "203.0.113.7", "192.0.2.1", 51234, 8000)
+	v6 := proxyV2(0x1, 0x21, "2001:db8::7", "2001:db8::1", 51234, 8000)
+
+	tests := []struct {
+		name   string
+		input  string // Sent by the balancer, the connection is closed after it
+		remote string // Client address from the header, "pipe" when the balancer's own address is kept
+		err    string // Part of the error, empty when the header is valid
+	}{
+		// Version 1, text
+		{name: "v1 TCP4", input: "PROXY TCP4 203.0.113.7 192.0.2.1 51234 8000\r\nTZ UTC\n", remote: "203.0.113.7:51234"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::7 2001:db8::1 51234 8000\r\nTZ UTC\n", remote: "[2001:db8::7]:51234"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\nTZ UTC\n", remote: "pipe"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nTZ UTC\n", remote: "pipe"},
+		{name: "v1 IPv6 address in TCP4", input: "PROXY TCP4 2001:db8::7 192.0.2.1 51234 8000\r\n", err: "invalid v1 source address"},
+		{name: "v1 bad port", input: "PROXY TCP4 203.0.113.7 192.0.2.1 70000 8000\r\n", err: "invalid v1 source port"},
+		{name: "v1 missing field", input: "PROXY TCP4 203.0.113.7 192.0.2.1 51234\r\n", err: "malformed v1 header"},
+		{name: "v1 unknown protocol", input: "PROXY UDP4 203.0.113.7 192.0.2.1 51234 8000\r\n", err: "malformed v1 header"},
+		{name: "v1 missing CRLF", input: "PROXY TCP4 203.0.113.7 192.0.2.1 51234 8000\nTZ UTC\n", err: "does not end with CRLF"},
+		{name: "v1 too long", input: "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n", err: "v1 header too long"},
+		{name: "v1 longer than the buffer", input: "PROXY TCP4 " + strings.Repeat("1", 300) + "\r\n", err: "v1 header too long"},
+		{name: "v1 truncated", input: "PROXY TCP4 203.0.113.7 192.0.2.1", err: "EOF"},
+
+		// Version 2, binary
+		{name: "v2 PROXY over IPv4", input: v4 + "TZ UTC\n", remote: "203.0.113.7:51234"},
+		{name: "v2 PROXY over IPv6", input: v6 + "TZ UTC\n", remote: "[2001:db8::7]:51234"},
+		{name: "v2 LOCAL over IPv4", input: proxyV2(0x0, 0x11, "10.0.0.1", "10.0.0.2", 1, 2) + "TZ UTC\n", remote: "pipe"},
+		{name: "v2 LOCAL over IPv6", input: proxyV2(0x0, 0x21, "fd00::1", "fd00::2", 1, 2) + "TZ UTC\n", remote: "pipe"},
+		{name: "v2 unspecified family", input: proxyV2(0x1, 0x00, "10.0.0.1", "10.0.0.2", 1, 2) + "TZ UTC\n", remote: "pipe"},
+		{name: "v2 wrong signature", input: strings.Replace(v4, "QUIT", "QUIX", 1), err: "does not start with a PROXY header"},
+		{name: "v2 wrong version", input: v4[:12] + "\x11" + v4[13:], err: "unsupported v2 header version 1"},
+		{name: "v2 unknown command", input: v4[:12] + "\x22" + v4[13:], err: "unknown v2 command"},
+		{name: "v2 IPv4 addresses cut short", input: v4[:14] + "\x00\x04" + v4[16:20], err: "too short for IPv4"},
+		{name: "v2 truncated header", input: v4[:14], err: "EOF"},
+		{name: "v2 truncated addresses", input: v4[:20], err: "EOF"},
+
+		{name: "no header", input: "TZ UTC\nPAUSE\n", err: "does not start with a PROXY header"},
+		{name: "nothing", input: "", err: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				io.WriteString(client, tt.input)
+				client.Close()
+			}()
+
+			conn, err := readProxyHeader(server, 5*time.Second)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("readProxyHeader error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader: %v", err)
+			}
+			if got := conn.RemoteAddr().String(); got != tt.remote {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.remote)
+			}
+			// Whatever followed the header is still there to read, even though parsing buffered it
+			if rest, err := io.ReadAll(conn); err != nil || string(rest) != "TZ UTC\n" {
+				t.Errorf("after the header: %q, %v; want the command that followed", rest, err)
+			}
+		})
+	}
+}
+
+// TestPrepareProxyHeader trusts 127.0.0.2 as a balancer and checks what each side gets over loopback.
+func TestPrepareProxyHeader(t *testing.T) {
+	srv, addr := startLoopback(t, "-interval", "1h", "-write-timeout", "200ms", "-proxy-trusted", "127.0.0.2")
+
+	t.Run("trusted upstream with a header", func(t *testing.T) {
+		conn := dialFrom(t, "127.0.0.2", addr)
+		io.WriteString(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 8000\r\n")
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || strings.HasPrefix(line, "ERR") {
+			t.Errorf("first line = %q, %v; want a tick", line, err)
+		}
+	})
+
+	t.Run("trusted upstream without a header", func(t *testing.T) {
+		// Sends nothing: once the header is overdue the connection is closed, without a tick or a reply
+		conn := dialFrom(t, "127.0.0.2", addr)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if got, err := io.ReadAll(conn); err != nil || len(got) != 0 {
+			t.Errorf("got %q, %v; want the connection closed without a word", got, err)
+		}
+		srv.metrics.mu.Lock()
+		rejected := srv.metrics.rejections[reasonProxyHeader]
+		srv.metrics.mu.Unlock()
+		if rejected != 1 {
+			t.Errorf("%d rejections for %s, want 1", rejected, reasonProxyHeader)
+		}
+	})
+
+	t.Run("untrusted peer sending a header", func(t *testing.T) {
+		conn := dialFrom(t, "127.0.0.3", addr)
+		io.WriteString(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 8000\r\n")
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		r.ReadString('\n') // The tick sent on connecting, before the header was read as a command
+		if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "ERR PROXY header not accepted") {
+			t.Errorf("reply = %q, %v; want the header refused", line, err)
+		}
+		if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+			t.Errorf("after the refusal: %q, %v; want the connection closed", rest, err)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Per-IP limits, so a single address cannot take every slot of -max-conns or keep the accept loop busy:
+//
+//   - a token bucket for new connections: the bucket holds up to "burst" tokens, refills at "rate" tokens
+//     per second, and every new connection takes one. An empty bucket means the connection is rejected.
+//     https://en.wikipedia.org/wiki/Token_bucket
+//   - a cap on the connections open at the same time from the same address.
+//
+// The limits themselves live in config (they can change on SIGHUP), ipLimiter only keeps the state per address.
+type ipLimiter struct {
+	mu        sync.Mutex
+	clients   map[netip.Addr]*ipState
+	lastSweep time.Time
+}
+
+type ipState struct {
+	tokens float64
+	last   time.Time // When tokens was last refilled
+	active int       // Connections open right now
+}
+
+// Entries of addresses with nothing open and a full bucket carry no information, they are dropped this often.
+const ipSweepInterval = time.Minute
+
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{clients: make(map[netip.Addr]*ipState)}
+}
+
+// acquire counts a new connection from ip, returning why it is rejected when it is.
+// A rate of 0 disables the token bucket, a maxConns of 0 disables the cap on open connections.
+// Accepted connections must be given back with release.
+func (l *ipLimiter) acquire(ip netip.Addr, rate float64, burst, maxConns int, now time.Time) (ok bool, why string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(rate, burst, now)
+
+	state, found := l.clients[ip]
+	if !found {
+		state = &ipState{tokens: float64(burst), last: now}
+		l.clients[ip] = state
+	}
+
+	if maxConns > 0 && state.active >= maxConns {
+		return false, fmt.Sprintf("too many connections from %s (limit %d)", ip, maxConns)
+	}
+	if rate > 0 {
+		state.refill(rate, burst, now)
+		if state.tokens < 1 {
+			return false, fmt.Sprintf("too many new connections from %s, slow down", ip)
+		}
+		state.tokens--
+	}
+	state.active++
+	return true, ""
+}
+
+// release gives back a connection accepted by acquire. Addresses that are not TCP are ignored, like in acquire.
+func (l *ipLimiter) release(addr net.Addr) {
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state, found := l.clients[ip]; found && state.active > 0 {
+		state.active--
+	}
+}
+
+// refill adds the tokens earned since the last refill, never going over burst.
+func (st *ipState) refill(rate float64, burst int, now time.Time) {
+	st.tokens = min(float64(burst), st.tokens+now.Sub(st.last).Seconds()*rate)
+	st.last = now
+}
+
+// sweep drops idle entries, so the map does not keep every address ever seen. l.mu must be held.
+func (l *ipLimiter) sweep(rate float64, burst int, now time.Time) {
+	if now.Sub(l.lastSweep) < ipSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for ip, state := range l.clients { // Deleting while ranging over a map is allowed: https://go.dev/ref/spec#For_range
+		if rate > 0 {
+			state.refill(rate, burst, now)
+		}
+		if state.active == 0 && (rate == 0 || state.tokens >= float64(burst)) {
+			delete(l.clients, ip)
+		}
+	}
+}
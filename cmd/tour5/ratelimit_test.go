@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIPLimiterAcquire(t *testing.T) {
+	start := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	ip := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+
+	// A step either acquires from ip (or other) at start+at, or releases one connection of it
+	type step struct {
+		at      time.Duration
+		from    netip.Addr
+		release bool
+		ok      bool
+		why     string
+	}
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		maxConns int
+		steps    []step
+	}{
+		{
+			name: "no limits",
+			steps: []step{
+				{from: ip, ok: true}, {from: ip, ok: true}, {from: ip, ok: true},
+			},
+		},
+		{
+			name: "burst then refused",
+			rate: 1, burst: 2,
+			steps: []step{
+				{from: ip, ok: true},
+				{from: ip, ok: true},
+				{from: ip, why: "too many new connections from 192.0.2.1, slow down"},
+				{from: other, ok: true}, // Every address has its own bucket
+			},
+		},
+		{
+			name: "refill at the rate",
+			rate: 2, burst: 1,
+			steps: []step{
+				{from: ip, ok: true},
+				{at: 400 * time.Millisecond, from: ip, why: "too many new connections from 192.0.2.1, slow down"},
+				{at: 500 * time.Millisecond, from: ip, ok: true}, // One token every 500ms
+				{at: 600 * time.Millisecond, from: ip, why: "too many new connections from 192.0.2.1, slow down"},
+			},
+		},
+		{
+			name: "refill never goes over burst",
+			rate: 1, burst: 2,
+			steps: []step{
+				{at: time.Hour, from: ip, ok: true},
+				{at: time.Hour, from: ip, ok: true},
+				{at: time.Hour, from: ip, why: "too many new connections from 192.0.2.1, slow down"},
+			},
+		},
+		{
+			name:     "open connections cap",
+			maxConns: 2,
+			steps: []step{
+				{from: ip, ok: true},
+				{from: ip, ok: true},
+				{from: ip, why: "too many connections from 192.0.2.1 (limit 2)"},
+				{from: other, ok: true},
+				{from: ip, release: true},
+				{from: ip, ok: true},
+			},
+		},
+		{
+			name:     "refused connections hold no slot",
+			maxConns: 1, rate: 1, burst: 1,
+			steps: []step{
+				{from: ip, ok: true},
+				{from: ip, release: true},
+				{from: ip, why: "too many new connections from 192.0.2.1, slow down"},
+				{at: time.Second, from: ip, ok: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newIPLimiter()
+			for i, st := range tt.steps {
+				if st.release {
+					l.release(net.TCPAddrFromAddrPort(netip.AddrPortFrom(st.from, 1234)))
+					continue
+				}
+				ok, why := l.acquire(st.from, tt.rate, tt.burst, tt.maxConns, start.Add(st.at))
+				if ok != st.ok || why != st.why {
+					t.Errorf("step %d: acquire(%s) = %v, %q; want %v, %q", i, st.from, ok, why, st.ok, st.why)
+				}
+			}
+		})
+	}
+}
+
+func TestIPLimiterRelease(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	ip := netip.MustParseAddr("192.0.2.1")
+	l := newIPLimiter()
+	l.acquire(ip, 0, 0, 0, now)
+
+	// Neither of these may touch the count, nor panic
+	l.release(&net.UnixAddr{Name: "/run/clock.sock", Net: "unix"})
+	l.release(net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.9:1")))
+	if got := l.clients[ip].active; got != 1 {
+		t.Fatalf("active = %d after releasing other addresses, want 1", got)
+	}
+
+	// The IPv4 address seen through an IPv6 socket is the same client
+	l.release(net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:192.0.2.1]:1")))
+	l.release(net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:1"))) // One too many, stays at 0
+	if got := l.clients[ip].active; got != 0 {
+		t.Errorf("active = %d, want 0", got)
+	}
+}
+
+func TestIPLimiterSweep(t *testing.T) {
+	start := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	idle := netip.MustParseAddr("192.0.2.1")   // Released, bucket full again by the sweep
+	open := netip.MustParseAddr("192.0.2.2")   // Still has a connection open
+	recent := netip.MustParseAddr("192.0.2.3") // Released, but the bucket is still refilling
+
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		at    time.Duration // When the sweep runs, after the connections below were made at start
+		kept  []netip.Addr
+	}{
+		{name: "before the interval", rate: 0.001, burst: 2, at: ipSweepInterval - time.Second, kept: []netip.Addr{idle, open, recent}},
+		{name: "without rate", at: ipSweepInterval, kept: []netip.Addr{open}},
+		{name: "with rate", rate: 0.01, burst: 1, at: ipSweepInterval, kept: []netip.Addr{open, recent}},
+		{name: "bucket refilled", rate: 1, burst: 1, at: ipSweepInterval, kept: []netip.Addr{open}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newIPLimiter()
+			l.lastSweep = start
+			l.acquire(idle, tt.rate, tt.burst, 0, start.Add(-time.Hour)) // Long ago, the bucket had time to refill
+			l.acquire(open, tt.rate, tt.burst, 0, start)
+			l.acquire(recent, tt.rate, tt.burst, 0, start)
+			for _, ip := range []netip.Addr{idle, recent} {
+				l.release(net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 1)))
+			}
+
+			l.mu.Lock()
+			l.sweep(tt.rate, tt.burst, start.Add(tt.at))
+			l.mu.Unlock()
+
+			if len(l.clients) != len(tt.kept) {
+				t.Errorf("%d entries left, want %d", len(l.clients), len(tt.kept))
+			}
+			for _, ip := range tt.kept {
+				if _, ok := l.clients[ip]; !ok {
+					t.Errorf("entry of %s dropped, want it kept", ip)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Zero-downtime restart: on SIGUSR2 the server starts a new copy of its own binary and passes its listening
+// sockets down as extra files. The listening socket itself is shared, so connections keep being queued by the
+// kernel the whole time: nobody gets "connection refused". Once the new process says it is accepting,
+// the old one stops accepting, drains its connections as in a regular shutdown and exits.
+// https://pkg.go.dev/os/exec#Cmd (ExtraFiles)
+
+// Environment variables describing what the new process inherits
+const (
+	inheritedEnv = "TOUR5_INHERITED_FDS" // Listener names and their file descriptors, e.g. "main:3,http:4"
+	readyEnv     = "TOUR5_READY_FD"      // Pipe the new process writes to once it is accepting
+)
+
+// How long the old process waits for the new one to be ready before giving up on the restart
+const restartTimeout = 10 * time.Second
+
+// listenerSet keeps the raw listeners (before any TLS wrapping) and UDP sockets of this process by name,
+// so they can be handed to the next one.
+type listenerSet struct {
+	inherited        map[string]net.Listener // Passed down by the previous process, if this one was started by a restart
+	inheritedPackets map[string]net.PacketConn
+	open             map[string]net.Listener
+	openPackets      map[string]net.PacketConn
+	ready            *os.File // Where to tell the previous process we are ready, nil when not started by a restart
+}
+
+// inheritListeners picks up the listeners passed by a restart, if any.
+func inheritListeners() (*listenerSet, error) {
+	set := &listenerSet{
+		inherited:        make(map[string]net.Listener),
+		inheritedPackets: make(map[string]net.PacketConn),
+		open:             make(map[string]net.Listener),
+		openPackets:      make(map[string]net.PacketConn),
+	}
+
+	spec, ok := os.LookupEnv(inheritedEnv)
+	if !ok {
+		return set, nil
+	}
+	readyFD := os.Getenv(readyEnv)
+	os.Unsetenv(inheritedEnv) // Meant for this process only, a later restart sets them again
+	os.Unsetenv(readyEnv)
+
+	for entry := range strings.SplitSeq(spec, ",") {
+		name, rawFD, _ := strings.Cut(entry, ":")
+		fd, err := strconv.Atoi(rawFD)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", inheritedEnv, entry)
+		}
+		listener, packetConn, err := inheritedSocket(fd, name)
+		if err != nil {
+			return nil, err
+		}
+		if packetConn != nil {
+			set.inheritedPackets[name] = packetConn
+			continue
+		}
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(true) // The socket file is ours now, remove it when we are done (like net.Listen does)
+		}
+		set.inherited[name] = listener
+	}
+
+	if fd, err := strconv.Atoi(readyFD); err == nil {
+		set.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	return set, nil
+}
+
+// listen returns the inherited listener called name, or opens a new one.
+func (set *listenerSet) listen(name string, open func() (net.Listener, error)) (net.Listener, error) {
+	listener, ok := set.inherited[name]
+	if ok {
+		delete(set.inherited, name)
+		slog.Info("Using listener inherited from the previous process", "listener", name, "addr", listener.Addr().String())
+	} else {
+		var err error
+		if listener, err = open(); err != nil {
+			return nil, err
+		}
+	}
+	set.open[name] = listener
+	return listener, nil
+}
+
+// listenPacket is listen for UDP sockets.
+func (set *listenerSet) listenPacket(name string, open func() (net.PacketConn, error)) (net.PacketConn, error) {
+	conn, ok := set.inheritedPackets[name]
+	if ok {
+		delete(set.inheritedPackets, name)
+		slog.Info("Using socket inherited from the previous process", "listener", name, "addr", conn.LocalAddr().String())
+	} else {
+		var err error
+		if conn, err = open(); err != nil {
+			return nil, err
+		}
+	}
+	set.openPackets[name] = conn
+	return conn, nil
+}
+
+// inheritedSocket turns a file descriptor passed by the previous process into a listener or, for UDP, a packet connection.
+func inheritedSocket(fd int, name string) (net.Listener, net.PacketConn, error) {
+	file := os.NewFile(uintptr(fd), name)
+	if file == nil {
+		return nil, nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer file.Close() // Both calls below work on a duplicate
+
+	if listener, err := net.FileListener(file); err == nil {
+		return listener, nil, nil
+	}
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("file descriptor %d is neither a listening nor a UDP socket: %w", fd, err)
+	}
+	return nil, conn, nil
+}
+
+// notifyReady tells the previous process (if any) that this one is accepting connections.
+func (set *listenerSet) notifyReady() {
+	// Inherited listeners nobody asked for (e.g. a flag was removed) would stay open forever otherwise
+	for name, listener := range set.inherited {
+		slog.Warn("Closing inherited listener that is no longer used", "listener", name)
+		listener.Close()
+	}
+	for name, conn := range set.inheritedPackets {
+		slog.Warn("Closing inherited socket that is no longer used", "listener", name)
+		conn.Close()
+	}
+	if set.ready == nil {
+		return
+	}
+	fmt.Fprintln(set.ready, "ready")
+	set.ready.Close()
+	set.ready = nil
+}
+
+// handOff starts a new copy of this program with the listeners attached and waits until it is accepting.
+// It returns the process ID of the new copy.
+func (set *listenerSet) handOff() (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	// The child sees ExtraFiles[i] as file descriptor 3+i
+	var files []*os.File
+	var entries []string
+	defer func() {
+		for _, f := range files {
+			f.Close() // Our copies, the child has its own
+		}
+	}()
+	sockets := make(map[string]any, len(set.open)+len(set.openPackets))
+	for name, listener := range set.open {
+		sockets[name] = listener
+	}
+	for name, conn := range set.openPackets {
+		sockets[name] = conn
+	}
+	for _, name := range slices.Sorted(maps.Keys(sockets)) {
+		withFile, ok := sockets[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %q cannot be passed to another process", name)
+		}
+		f, err := withFile.File() // A duplicate of the socket, closing it does not affect our listener
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, fmt.Sprintf("%s:%d", name, 3+len(files)))
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		inheritedEnv+"="+strings.Join(entries, ","),
+		readyEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close() // Only the child keeps the write end, so reading gets EOF if it dies before being ready
+	if err != nil {
+		return 0, err
+	}
+
+	// Waiting for "ready", for EOF (the child died) or for the timeout, whatever happens first
+	result := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(readyR).ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != "ready" {
+			result <- errors.New("new process exited before accepting connections")
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(restartTimeout):
+		err = fmt.Errorf("new process not ready after %v", restartTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+
+	// The new process outlives us, releasing it means we never wait for it
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// keepSocketFiles stops Unix listeners from removing their socket file when closed,
+// the new process is still listening on it.
+func (set *listenerSet) keepSocketFiles() {
+	for _, listener := range set.open {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRestartRefusesNothing builds the real binary, keeps dialing it from another goroutine and sends SIGUSR2 in the
+// middle. The listening socket is shared by the old and the new process the whole time, so no dial may be refused.
+func TestRestartRefusesNothing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the binary")
+	}
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "tour5")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+
+	addr := freeAddr(t)
+	// A file, not a pipe: the new process inherits it, and a pipe would keep Wait below waiting for the new process too
+	logs, err := os.Create(filepath.Join(dir, "tour5.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logs.Close()
+	cmd := exec.Command(bin, "-addr", addr, "-shutdown-timeout", "1s")
+	cmd.Stdout, cmd.Stderr = logs, logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{}) // Closed, not sent on, both the test and the cleanup wait for it
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Kill() // Fails harmlessly once it exited on its own
+		<-exited
+		if pid, ok := restartedPID(logs.Name()); ok {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	})
+
+	if err := waitDial(addr, 10*time.Second); err != nil {
+		t.Fatalf("server never accepted: %v\n%s", err, readLogs(logs.Name()))
+	}
+
+	var dials, refused atomic.Int64
+	var otherErr atomic.Value
+	stop := make(chan struct{})
+	var dialer sync.WaitGroup
+	dialer.Go(func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			dials.Add(1)
+			switch {
+			case errors.Is(err, syscall.ECONNREFUSED):
+				refused.Add(1)
+			case err != nil:
+				otherErr.Store(err)
+			default:
+				conn.Close()
+			}
+		}
+	})
+
+	time.Sleep(100 * time.Millisecond) // Some dials before the signal too
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(restartTimeout + 5*time.Second):
+		t.Fatalf("old process still running after SIGUSR2\n%s", readLogs(logs.Name()))
+	}
+	pid, ok := restartedPID(logs.Name())
+	if !ok {
+		t.Fatalf("old process exited without handing off\n%s", readLogs(logs.Name()))
+	}
+	time.Sleep(100 * time.Millisecond) // And some once only the new process is left
+	close(stop)
+	dialer.Wait()
+
+	if n := refused.Load(); n > 0 {
+		t.Errorf("%d of %d dials refused during the restart\n%s", n, dials.Load(), readLogs(logs.Name()))
+	}
+	if err, _ := otherErr.Load().(error); err != nil {
+		t.Errorf("dial failed: %v", err)
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Errorf("new process %d is not running: %v", pid, err)
+	}
+	t.Logf("%d dials, new process %d", dials.Load(), pid)
+}
+
+// freeAddr returns a loopback address nobody listens on, by letting the kernel pick a port and giving it back.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// waitDial dials addr until it works or timeout passes.
+func waitDial(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+var restartedRE = regexp.MustCompile(`restarted as process (\d+)`)
+
+// restartedPID finds the process the old one handed off to, in the log line it writes while stopping.
+func restartedPID(logFile string) (int, bool) {
+	m := restartedRE.FindStringSubmatch(readLogs(logFile))
+	if m == nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(m[1])
+	return pid, err == nil
+}
+
+func readLogs(logFile string) string {
+	b, _ := os.ReadFile(logFile)
+	return string(b)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+
+	"golang_learning/timerpc"
+)
+
+// Time service for programs, over net/rpc with the JSON codec. The argument and reply types live in the
+// timerpc package, which is also the Go client:
+//
+//	Time.Now(zone, layout)             the current time
+//	Time.Convert(t, fromZone, toZone)  a time from one zone in another
+//	Time.Until(target, zone)           how long until target
+//
+// Connections go through serveClient like the streaming ones, so TLS, PROXY headers, the allow/deny lists,
+// the limits, the metrics and the shutdown path are all shared.
+// https://pkg.go.dev/net/rpc
+
+// timeService holds the methods net/rpc exposes. Only exported methods of the form
+// "func (t *T) Name(args A, reply *R) error" are registered, so everything else stays private.
+type timeService struct {
+	s *server
+}
+
+// newRPCServer registers the time service under timerpc.ServiceName. A server of our own, instead of
+// the package-level rpc.DefaultServer, keeps it out of reach of anything else registering there.
+func newRPCServer(s *server) *rpc.Server {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName(timerpc.ServiceName, &timeService{s: s}); err != nil {
+		panic(err) // Only possible if the methods above stop having the shape net/rpc wants, a programming error
+	}
+	return rpcServer
+}
+
+// serveRPC accepts RPC connections on listener until ctx is cancelled.
+func (s *server) serveRPC(ctx context.Context, listener net.Listener) {
+	context.AfterFunc(ctx, func() { listener.Close() })
+	rpcServer := newRPCServer(s)
+	slog.Info("Serving JSON-RPC", "addr", listener.Addr().String())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Error accepting RPC connection", "err", err)
+			s.metrics.acceptErrors.Add(1)
+			continue
+		}
+		// Started outside serve, like the HTTP streams, so it joins the WaitGroup through enter
+		if !s.enter() {
+			conn.Close()
+			return // Already draining
+		}
+		c := newClient(s.lastID.Add(1), conn, s.clock)
+		c.log = c.log.With("frontend", "rpc")
+		c.log.Info("Connection accepted")
+		s.metrics.totalConns.Add(1)
+		s.track(conn)
+		go func() {
+			defer s.wg.Done()
+			if s.prepare(c) {
+				s.serveClient(ctx, c, func(ctx context.Context, c *client) string { return s.handleRPC(ctx, c, rpcServer) })
+			}
+		}()
+	}
+}
+
+// handleRPC answers calls on c until the client hangs up or the server shuts down.
+func (s *server) handleRPC(ctx context.Context, c *client, rpcServer *rpc.Server) (reason string) {
+	defer s.untrack(c.conn)
+
+	// On shutdown the next read fails right away, which makes ServeCodec stop reading requests.
+	// It still waits for the calls already running and sends their replies before returning.
+	stop := context.AfterFunc(ctx, func() { c.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	rpcServer.ServeCodec(jsonrpc.NewServerCodec(c.conn))
+	if ctx.Err() != nil {
+		s.drained.Add(1)
+		return reasonShutdown
+	}
+	return reasonClientGone
+}
+
+// Now answers Time.Now.
+func (t *timeService) Now(args timerpc.NowArgs, reply *timerpc.TimeReply) error {
+	cfg := t.s.config()
+	loc, err := rpcLocation(args.Zone, cfg)
+	if err != nil {
+		return err
+	}
+	format := cfg.format
+	if args.Layout != "" {
+		if format, err = parseFormat(args.Layout); err != nil {
+			return err
+		}
+	}
+	t.s.metrics.rpcCalls.Add(1)
+
+	now := t.s.clock.Now().In(loc)
+	*reply = timerpc.TimeReply{Time: now, Zone: loc.String(), Formatted: format.format(now)}
+	return nil
+}
+
+// Convert answers Time.Convert.
+func (t *timeService) Convert(args timerpc.ConvertArgs, reply *timerpc.TimeReply) error {
+	cfg := t.s.config()
+	from, err := rpcLocation(args.From, cfg)
+	if err != nil {
+		return err
+	}
+	to, err := rpcLocation(args.To, cfg)
+	if err != nil {
+		return err
+	}
+	when, timeOfDay, err := parseTimeArg(args.Time, from)
+	if err != nil {
+		return err
+	}
+	if timeOfDay {
+		today := t.s.clock.Now().In(from)
+		when = time.Date(today.Year(), today.Month(), today.Day(), when.Hour(), when.Minute(), when.Second(), when.Nanosecond(), from)
+	}
+	t.s.metrics.rpcCalls.Add(1)
+
+	converted := when.In(to)
+	*reply = timerpc.TimeReply{Time: converted, Zone: to.String(), Formatted: converted.Format(time.RFC3339Nano)}
+	return nil
+}
+
+// Until answers Time.Until.
+func (t *timeService) Until(args timerpc.UntilArgs, reply *timerpc.UntilReply) error {
+	loc, err := rpcLocation(args.Zone, t.s.config())
+	if err != nil {
+		return err
+	}
+	target, timeOfDay, err := parseTimeArg(args.Target, loc)
+	if err != nil {
+		return err
+	}
+	now := t.s.clock.Now()
+	if timeOfDay {
+		target = nextTimeOfDay(now, target, loc)
+	}
+	t.s.metrics.rpcCalls.Add(1)
+
+	*reply = timerpc.UntilReply{Target: target, Duration: target.Sub(now)}
+	return nil
+}
+
+// rpcLocation loads zone, or returns the server default when it is empty.
+// The error goes back to the caller as is, net/rpc sends its text as the "error" of the reply.
+func rpcLocation(zone string, cfg *config) (*time.Location, error) {
+	if zone == "" {
+		return cfg.location, nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", zone)
+	}
+	return loc, nil
+}
+
+// parseTimeArg reads the times Convert and Until accept: RFC 3339 (with its own offset), a date and time
+// in loc, or a time of day. For the last one only the clock fields mean anything and timeOfDay is true,
+// the caller decides which day it is on.
+func parseTimeArg(value string, loc *time.Location) (t time.Time, timeOfDay bool, err error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, false, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, false, nil
+		}
+	}
+	if t, err := parseTimeOfDay(value); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf(`invalid time %q: use RFC 3339, "2006-01-02 15:04[:05]" or "15:04[:05]"`, value)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang_learning/timerpc"
+)
+
+// rpcHarness is serveRPC on a loopback listener, with the clock stopped at harnessStart.
+type rpcHarness struct {
+	srv    *server
+	addr   string
+	cancel context.CancelCauseFunc
+	done   chan struct{} // Closed when serveRPC returned
+}
+
+func startRPC(t *testing.T, args ...string) *rpcHarness {
+	t.Helper()
+	cfg, err := loadConfig(append([]string{"-tz", "UTC"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &rpcHarness{srv: newServer(cfg, cfg, newPipeListener(), newFakeClock(harnessStart)), addr: listener.Addr().String(), done: make(chan struct{})}
+
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancelCause(context.Background())
+	go func() {
+		h.srv.serveRPC(ctx, listener)
+		close(h.done)
+	}()
+	t.Cleanup(func() {
+		h.cancel(errors.New("test finished"))
+		<-h.done
+		h.srv.drain(time.Second)
+	})
+	return h
+}
+
+func (h *rpcHarness) dial(t *testing.T) *timerpc.Client {
+	t.Helper()
+	c, err := timerpc.Dial(h.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestRPCNow(t *testing.T) {
+	h := startRPC(t)
+	c := h.dial(t)
+
+	tests := []struct {
+		zone, layout string
+		wantZone     string
+		formatted    string
+	}{
+		{wantZone: "UTC", formatted: "12:00:00"},
+		{zone: "Asia/Tokyo", wantZone: "Asia/Tokyo", formatted: "21:00:00"},
+		{zone: "Asia/Tokyo", layout: "kitchen", wantZone: "Asia/Tokyo", formatted: "9:00PM"},
+		{zone: "America/Sao_Paulo", layout: "2006-01-02 15:04 MST", wantZone: "America/Sao_Paulo", formatted: "2026-10-18 09:00 -03"},
+		{layout: "unix", wantZone: "UTC", formatted: "1792324800"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.zone+" "+tt.layout, func(t *testing.T) {
+			reply, err := c.Now(testContext(t), tt.zone, tt.layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Zone != tt.wantZone || reply.Formatted != tt.formatted || !reply.Time.Equal(harnessStart) {
+				t.Errorf("Now(%q, %q) = %+v, want zone %q, %q at %v", tt.zone, tt.layout, reply, tt.wantZone, tt.formatted, harnessStart)
+			}
+		})
+	}
+}
+
+func TestRPCConvert(t *testing.T) {
+	h := startRPC(t)
+	c := h.dial(t)
+
+	tests := []struct {
+		name       string
+		time, from string
+		to         string
+		wantZone   string
+		formatted  string
+	}{
+		{name: "date and time", time: "2026-10-18 15:30", from: "America/Sao_Paulo", to: "Asia/Tokyo", wantZone: "Asia/Tokyo", formatted: "2026-10-19T03:30:00+09:00"},
+		{name: "with seconds", time: "2026-10-18 15:30:05", from: "UTC", to: "Europe/Paris", wantZone: "Europe/Paris", formatted: "2026-10-18T17:30:05+02:00"},
+		{name: "RFC 3339 ignores from", time: "2026-10-18T15:30:00Z", from: "Asia/Tokyo", to: "UTC", wantZone: "UTC", formatted: "2026-10-18T15:30:00Z"},
+		{name: "time of day is today in from", time: "09:00", from: "UTC", to: "Asia/Tokyo", wantZone: "Asia/Tokyo", formatted: "2026-10-18T18:00:00+09:00"},
+		{name: "server zone by default", time: "2026-10-18 15:30", wantZone: "UTC", formatted: "2026-10-18T15:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := c.Convert(testContext(t), tt.time, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Zone != tt.wantZone || reply.Formatted != tt.formatted {
+				t.Errorf("Convert(%q, %q, %q) = %q in %q, want %q in %q", tt.time, tt.from, tt.to, reply.Formatted, reply.Zone, tt.formatted, tt.wantZone)
+			}
+		})
+	}
+}
+
+func TestRPCUntil(t *testing.T) {
+	h := startRPC(t)
+	c := h.dial(t)
+
+	tests := []struct {
+		name, target, zone string
+		want               time.Duration
+	}{
+		{name: "later today", target: "12:30", want: 30 * time.Minute},
+		{name: "earlier means tomorrow", target: "11:00", want: 23 * time.Hour},
+		{name: "now means tomorrow", target: "12:00:00", want: 24 * time.Hour},
+		{name: "in another zone", target: "22:00", zone: "Asia/Tokyo", want: time.Hour},
+		{name: "date in the past", target: "2026-10-18 11:00", want: -time.Hour},
+		{name: "RFC 3339", target: "2026-10-19T12:00:00Z", want: 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := c.Until(testContext(t), tt.target, tt.zone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Duration != tt.want || !reply.Target.Equal(harnessStart.Add(tt.want)) {
+				t.Errorf("Until(%q, %q) = %v (target %v), want %v", tt.target, tt.zone, reply.Duration, reply.Target, tt.want)
+			}
+		})
+	}
+}
+
+func TestRPCErrors(t *testing.T) {
+	h := startRPC(t)
+	c := h.dial(t)
+	ctx := testContext(t)
+
+	tests := []struct {
+		name string
+		call func() error
+		want string
+	}{
+		{name: "Now unknown zone", call: func() error { _, err := c.Now(ctx, "Mars/Olympus", ""); return err }, want: `unknown time zone "Mars/Olympus"`},
+		{name: "Now invalid layout", call: func() error { _, err := c.Now(ctx, "", "hello"); return err }, want: `invalid format "hello"`},
+		{name: "Convert unknown from", call: func() error { _, err := c.Convert(ctx, "12:00", "Nowhere", "UTC"); return err }, want: `unknown time zone "Nowhere"`},
+		{name: "Convert unknown to", call: func() error { _, err := c.Convert(ctx, "12:00", "UTC", "Nowhere"); return err }, want: `unknown time zone "Nowhere"`},
+		{name: "Convert invalid time", call: func() error { _, err := c.Convert(ctx, "noon", "", ""); return err }, want: `invalid time "noon"`},
+		{name: "Until unknown zone", call: func() error { _, err := c.Until(ctx, "12:00", "Nowhere"); return err }, want: `unknown time zone "Nowhere"`},
+		{name: "Until invalid time", call: func() error { _, err := c.Until(ctx, "25:00", ""); return err }, want: `invalid time "25:00"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+
+	// Errors are answers, not broken connections: the client still works, and failed calls are not counted
+	if _, err := c.Now(ctx, "", ""); err != nil {
+		t.Errorf("call after the errors: %v", err)
+	}
+	if got := h.srv.metrics.rpcCalls.Load(); got != 1 {
+		t.Errorf("rpc calls = %d, want 1", got)
+	}
+}
+
+func TestRPCCancelledContext(t *testing.T) {
+	// A server that accepts and never answers, so the only way out of the call is the context
+	mute, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mute.Close()
+	go func() {
+		conn, err := mute.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn) // Reads the requests until the client hangs up
+			conn.Close()
+		}
+	}()
+	c, err := timerpc.Dial(mute.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cause := errors.New("caller gave up")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(50*time.Millisecond, func() { cancel(cause) })
+	start := time.Now()
+	if _, err := c.Now(ctx, "", ""); !errors.Is(err, cause) {
+		t.Errorf("error = %v, want the cancel cause", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("call returned after %v, long after the cancel", elapsed)
+	}
+
+	// On the real server an abandoned call leaves the client usable, its late reply goes nowhere
+	h := startRPC(t)
+	c = h.dial(t)
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	c.Until(cancelled, "12:30", "") // May or may not get the reply first, either is fine
+	if reply, err := c.Now(testContext(t), "Asia/Tokyo", ""); err != nil || reply.Formatted != "21:00:00" {
+		t.Errorf("call after an abandoned one = %+v, %v", reply, err)
+	}
+}
+
+func TestRPCShutdownWithOpenConnection(t *testing.T) {
+	h := startRPC(t)
+	c := h.dial(t)
+	ctx := testContext(t)
+	if _, err := c.Now(ctx, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is idle, waiting for the next request: shutting down ends it right away instead of at the deadline
+	h.cancel(errors.New("shutting down"))
+	<-h.done
+	start := time.Now()
+	drained, forced := h.srv.drain(5 * time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %v", elapsed)
+	}
+	if drained != 1 || forced != 0 {
+		t.Errorf("drained %d and forced %d connections, want 1 and 0", drained, forced)
+	}
+	h.srv.metrics.mu.Lock()
+	shutdowns := h.srv.metrics.disconnects[reasonShutdown]
+	h.srv.metrics.mu.Unlock()
+	if shutdowns != 1 {
+		t.Errorf("%d connections ended by the shutdown, want 1", shutdowns)
+	}
+
+	if _, err := c.Now(ctx, "", ""); err == nil {
+		t.Error("call after the shutdown succeeded, want the connection closed")
+	}
+	if _, err := timerpc.Dial(h.addr); err == nil {
+		t.Error("dial after the shutdown succeeded, want the listener closed")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// Simple Network Time Protocol, the subset of NTP that clients such as "sntp", "ntpdate -q" or chrony's
+// "chronyd -Q" speak: one UDP request, one reply, both the same 48-byte packet.
+// https://datatracker.ietf.org/doc/html/rfc4330
+//
+//	 0                   1                   2                   3
+//	|LI | VN  |Mode |    Stratum    |     Poll      |   Precision   |
+//	|                          Root Delay                           |
+//	|                       Root Dispersion                         |
+//	|                     Reference Identifier                      |
+//	|                   Reference Timestamp (64)                    |
+//	|                   Originate Timestamp (64)                    |
+//	|                    Receive Timestamp (64)                     |
+//	|                    Transmit Timestamp (64)                    |
+const sntpPacketSize = 48
+
+const (
+	sntpModeClient = 3
+	sntpModeServer = 4
+
+	// This server reads the local clock, which nothing here disciplines: RFC 4330 calls that a stratum 1
+	// server with the reference identifier "LOCL" (uncalibrated local clock).
+	sntpStratum   = 1
+	sntpReference = "LOCL"
+
+	// Precision of the clock as a power of two in seconds: 2^-20 is about a microsecond.
+	sntpPrecision = -20
+
+	// Root dispersion is the error the server claims relative to the reference. An uncalibrated clock has
+	// no real bound, so this is a conservative guess that keeps clients from trusting it too much.
+	sntpRootDispersion = 10 * time.Millisecond
+)
+
+// Seconds between the NTP epoch (1900-01-01) and the Unix epoch (1970-01-01)
+const ntpEpochOffset = 2208988800
+
+// ntpTimestamp encodes t in the 64-bit NTP format: seconds since 1900 and a 32-bit binary fraction of a second.
+// The seconds wrap around in 2036 (era 1), which this encoding does on its own by keeping the low 32 bits.
+func ntpTimestamp(t time.Time) uint64 {
+	seconds := uint64(t.Unix()+ntpEpochOffset) & math.MaxUint32
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// ntpTime decodes an NTP timestamp. RFC 4330 section 3: when the most significant bit of the seconds is 0,
+// the time is in era 1 (from 2036-02-07 on), otherwise in era 0 (from 1968).
+func ntpTime(ts uint64) time.Time {
+	seconds, fraction := int64(ts>>32), ts&math.MaxUint32
+	if seconds&0x80000000 == 0 {
+		seconds += 1 << 32
+	}
+	nanos := int64(fraction * uint64(time.Second) >> 32)
+	return time.Unix(seconds-ntpEpochOffset, nanos)
+}
+
+// ntpShort encodes d in the 32-bit NTP short format (16 bits of seconds, 16 of fraction), used for root delay and dispersion.
+func ntpShort(d time.Duration) uint32 {
+	return uint32(d.Seconds() * (1 << 16))
+}
+
+// serveSNTP answers SNTP requests arriving on conn until ctx is cancelled.
+// Each request is answered right away in this goroutine: the work is a few field copies, there is nothing to wait on.
+func (s *server) serveSNTP(ctx context.Context, conn net.PacketConn) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() }) // Unblocks ReadFrom below
+	defer stop()
+
+	reference := s.clock.Now() // When the clock was last set; nothing ever sets it, so the start of the server
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		received := s.clock.Now()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Error reading SNTP request", "err", err)
+			continue
+		}
+
+		// Same filter as the TCP clock, but a denied address simply gets no answer: UDP has no connection to refuse
+		if ip, ok := remoteUDPIP(addr); ok {
+			if allowed, _ := s.config().filter.allowed(ip); !allowed {
+				continue
+			}
+		}
+
+		reply, err := sntpReply(buf[:n], received, reference, s.clock)
+		if err != nil {
+			slog.Debug("Ignoring SNTP packet", "remote", addr.String(), "err", err)
+			continue
+		}
+		if _, err := conn.WriteTo(reply, addr); err != nil {
+			slog.Warn("Error answering SNTP request", "remote", addr.String(), "err", err)
+			continue
+		}
+		s.metrics.sntpRequests.Add(1)
+	}
+}
+
+// sntpReply builds the answer to request, received at the given time. The transmit time is read from clk.
+func sntpReply(request []byte, received, reference time.Time, clk clock) ([]byte, error) {
+	if len(request) < sntpPacketSize {
+		return nil, fmt.Errorf("packet too short (%d bytes)", len(request))
+	}
+	version, mode := request[0]>>3&0x7, request[0]&0x7
+	if mode != sntpModeClient {
+		return nil, fmt.Errorf("not a client request (mode %d)", mode)
+	}
+	if version < 1 || version > 4 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	reply := make([]byte, sntpPacketSize)
+	reply[0] = version<<3 | sntpModeServer // Leap indicator 0 (no warning), same version as the client
+	reply[1] = sntpStratum
+	reply[2] = request[2]            // Poll interval, echoed as RFC 4330 suggests
+	precision := int8(sntpPrecision) // Signed, sent as its two's complement byte
+	reply[3] = byte(precision)
+	binary.BigEndian.PutUint32(reply[4:8], 0) // Root delay: the reference is the local clock itself
+	binary.BigEndian.PutUint32(reply[8:12], ntpShort(sntpRootDispersion))
+	copy(reply[12:16], sntpReference)
+	binary.BigEndian.PutUint64(reply[16:24], ntpTimestamp(reference))
+	copy(reply[24:32], request[40:48]) // Originate: the client's transmit timestamp, copied as is so the client can match the reply
+	binary.BigEndian.PutUint64(reply[32:40], ntpTimestamp(received))
+	binary.BigEndian.PutUint64(reply[40:48], ntpTimestamp(clk.Now())) // As late as possible
+	return reply, nil
+}
+
+func remoteUDPIP(addr net.Addr) (ip netip.Addr, ok bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return ip, false
+	}
+	return udpAddr.AddrPort().Addr().Unmap(), true
+}
+
+// sntpClient is the "tour5 sntp" subcommand: it queries an SNTP server once and prints the result.
+// It returns the exit status.
+func sntpClient(args []string) int {
+	flags := flag.NewFlagSet("tour5 sntp", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 2*time.Second, "How long to wait for the answer")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: tour5 sntp [-timeout 2s] host[:port]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	addr := flags.Arg(0)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "123") // The NTP port
+	}
+
+	result, err := querySNTP(addr, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "SNTP query failed:", err)
+		return 1
+	}
+	fmt.Printf("server:      %s\n", addr)
+	fmt.Printf("stratum:     %d (%s)\n", result.stratum, result.reference)
+	fmt.Printf("server time: %s\n", result.time.Format(time.RFC3339Nano))
+	sign := "+" // Durations only print their sign when negative
+	if result.offset < 0 {
+		sign = ""
+	}
+	fmt.Printf("offset:      %s%v\n", sign, result.offset)
+	fmt.Printf("delay:       %v\n", result.delay)
+	return 0
+}
+
+type sntpResult struct {
+	stratum   int
+	reference string
+	time      time.Time     // Server time when it sent the answer
+	offset    time.Duration // How far the local clock is behind (positive) or ahead (negative) of the server
+	delay     time.Duration // Round trip, minus the time the server spent on the request
+}
+
+// querySNTP sends one request to addr and checks the answer.
+func querySNTP(addr string, timeout time.Duration) (sntpResult, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return sntpResult{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// The transmit timestamp only has to come back unchanged in the originate field, so instead of the
+	// local time (which would tell the server our clock) it is random, which also makes replies hard to forge.
+	request := make([]byte, sntpPacketSize)
+	request[0] = 4<<3 | sntpModeClient // Version 4, client
+	rand.Read(request[40:48])
+
+	t1 := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return sntpResult{}, err
+	}
+	reply := make([]byte, 512)
+	n, err := conn.Read(reply)
+	t4 := time.Now()
+	if err != nil {
+		return sntpResult{}, err
+	}
+	if n < sntpPacketSize {
+		return sntpResult{}, fmt.Errorf("reply too short (%d bytes)", n)
+	}
+
+	// The checks RFC 4330 section 5 asks clients to make
+	if mode := reply[0] & 0x7; mode != sntpModeServer {
+		return sntpResult{}, fmt.Errorf("unexpected mode %d in reply", mode)
+	}
+	if string(reply[24:32]) != string(request[40:48]) {
+		return sntpResult{}, errors.New("reply does not answer our request (originate timestamp mismatch)")
+	}
+	stratum := int(reply[1])
+	if stratum == 0 {
+		return sntpResult{}, fmt.Errorf("kiss-o'-death from the server: %q", reply[12:16])
+	}
+	if binary.BigEndian.Uint64(reply[40:48]) == 0 {
+		return sntpResult{}, errors.New("reply has no transmit timestamp")
+	}
+
+	t2 := ntpTime(binary.BigEndian.Uint64(reply[32:40])) // Server received the request
+	t3 := ntpTime(binary.BigEndian.Uint64(reply[40:48])) // Server sent the reply
+
+	// The usual NTP formulas, with T1 and T4 on our clock and T2 and T3 on the server's:
+	// offset = ((T2 - T1) + (T3 - T4)) / 2, delay = (T4 - T1) - (T3 - T2)
+	result := sntpResult{
+		stratum: stratum,
+		time:    t3,
+		offset:  (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		delay:   t4.Sub(t1) - t3.Sub(t2),
+	}
+	if stratum == 1 {
+		result.reference = strings.TrimRight(string(reply[12:16]), "\x00") // Up to four ASCII characters, e.g. "GPS" or "LOCL"
+	} else {
+		result.reference = net.IP(reply[12:16]).String() // IPv4 address of the server's own source
+	}
+	return result, nil
+}
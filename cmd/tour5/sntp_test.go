@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNTPTimestamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		time      time.Time
+		ts        uint64 // Encoded
+		roundTrip bool   // Only check that the time comes back, not ts
+	}{
+		{name: "Unix epoch", time: time.Unix(0, 0), ts: ntpEpochOffset << 32},
+		{name: "half a second", time: time.Unix(0, 500_000_000), ts: ntpEpochOffset<<32 | 1<<31},
+		{name: "today", time: time.Date(2026, time.October, 18, 12, 0, 0, 250_000_000, time.UTC), roundTrip: true},
+		{name: "start of era 0 as read here", time: time.Date(1968, time.January, 20, 3, 14, 8, 0, time.UTC), ts: 0x80000000 << 32},
+		{name: "last second of era 0", time: time.Date(2036, time.February, 7, 6, 28, 15, 0, time.UTC), ts: 0xffffffff << 32},
+		{name: "first second of era 1", time: time.Date(2036, time.February, 7, 6, 28, 16, 0, time.UTC), ts: 0},
+		{name: "into era 1", time: time.Date(2036, time.February, 7, 6, 28, 17, 750_000_000, time.UTC), ts: 1<<32 | 3<<30},
+		{name: "2100", time: time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC), roundTrip: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := ntpTimestamp(tt.time)
+			if !tt.roundTrip && ts != tt.ts {
+				t.Errorf("ntpTimestamp(%v) = %#x, want %#x", tt.time, ts, tt.ts)
+			}
+			if back := ntpTime(ts); !back.Equal(tt.time) {
+				t.Errorf("ntpTime(%#x) = %v, want %v back", ts, back.UTC(), tt.time)
+			}
+		})
+	}
+
+	// A fraction of a second that is not a power of two is rounded down, to within a nanosecond
+	at := time.Date(2026, time.October, 18, 12, 0, 0, 123_456_789, time.UTC)
+	if diff := at.Sub(ntpTime(ntpTimestamp(at))); diff < 0 || diff > time.Nanosecond {
+		t.Errorf("round trip of %v is %v off", at, diff)
+	}
+}
+
+// sntpRequest builds a client request with the given version and mode, and transmit as its transmit timestamp.
+func sntpRequest(version, mode byte, transmit uint64) []byte {
+	request := make([]byte, sntpPacketSize)
+	request[0] = version<<3 | mode
+	request[2] = 6 // Poll interval, 2^6 seconds
+	binary.BigEndian.PutUint64(request[40:48], transmit)
+	return request
+}
+
+func TestSNTPReply(t *testing.T) {
+	received := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	reference := received.Add(-time.Hour)
+	const transmit = 0x0123456789abcdef // Whatever the client put there, not necessarily a time
+
+	tests := []struct {
+		name    string
+		request []byte
+		err     string // Part of the error, empty when the request must be answered
+	}{
+		{name: "version 4", request: sntpRequest(4, sntpModeClient, transmit)},
+		{name: "version 3", request: sntpRequest(3, sntpModeClient, transmit)},
+		{name: "version 1", request: sntpRequest(1, sntpModeClient, transmit)},
+		{name: "longer than needed", request: append(sntpRequest(4, sntpModeClient, transmit), make([]byte, 20)...)}, // Extension fields, ignored
+		{name: "too short", request: sntpRequest(4, sntpModeClient, transmit)[:sntpPacketSize-1], err: "packet too short (47 bytes)"},
+		{name: "empty", request: nil, err: "packet too short (0 bytes)"},
+		{name: "server mode", request: sntpRequest(4, sntpModeServer, transmit), err: "not a client request (mode 4)"},
+		{name: "symmetric active mode", request: sntpRequest(4, 1, transmit), err: "not a client request (mode 1)"},
+		{name: "version 0", request: sntpRequest(0, sntpModeClient, transmit), err: "unsupported version 0"},
+		{name: "version 5", request: sntpRequest(5, sntpModeClient, transmit), err: "unsupported version 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := received.Add(250 * time.Millisecond)
+			reply, err := sntpReply(tt.request, received, reference, newFakeClock(sent))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("sntpReply error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(reply) != sntpPacketSize {
+				t.Fatalf("reply is %d bytes, want %d", len(reply), sntpPacketSize)
+			}
+			if version, mode := reply[0]>>3&0x7, reply[0]&0x7; version != tt.request[0]>>3 || mode != sntpModeServer {
+				t.Errorf("reply version %d, mode %d; want the client's version %d and mode %d", version, mode, tt.request[0]>>3, sntpModeServer)
+			}
+			if reply[0]>>6 != 0 {
+				t.Errorf("leap indicator = %d, want 0", reply[0]>>6)
+			}
+			if reply[1] != sntpStratum || string(reply[12:16]) != sntpReference {
+				t.Errorf("stratum %d, reference %q; want %d, %q", reply[1], reply[12:16], sntpStratum, sntpReference)
+			}
+			if reply[2] != tt.request[2] {
+				t.Errorf("poll = %d, want the client's %d echoed", reply[2], tt.request[2])
+			}
+			if got := binary.BigEndian.Uint64(reply[24:32]); got != transmit {
+				t.Errorf("originate = %#x, want the client's transmit timestamp %#x", got, transmit)
+			}
+			if got := ntpTime(binary.BigEndian.Uint64(reply[16:24])); !got.Equal(reference) {
+				t.Errorf("reference timestamp = %v, want %v", got, reference)
+			}
+			if got := ntpTime(binary.BigEndian.Uint64(reply[32:40])); !got.Equal(received) {
+				t.Errorf("receive timestamp = %v, want %v", got, received)
+			}
+			if got := ntpTime(binary.BigEndian.Uint64(reply[40:48])); !got.Equal(sent) {
+				t.Errorf("transmit timestamp = %v, want %v from the clock", got, sent)
+			}
+		})
+	}
+}
+
+// TestQuerySNTP runs the server on a fake clock an hour and a half ahead, which the client should measure as its offset.
+func TestQuerySNTP(t *testing.T) {
+	const ahead = 90 * time.Minute
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg, cfg, nil, newFakeClock(time.Now().Add(ahead)))
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.serveSNTP(ctx, conn)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	result, err := querySNTP(conn.LocalAddr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.stratum != sntpStratum || result.reference != sntpReference {
+		t.Errorf("stratum %d, reference %q; want %d, %q", result.stratum, result.reference, sntpStratum, sntpReference)
+	}
+	// The fake clock stands still while the real one goes on, so the offset comes out a little short
+	if diff := ahead - result.offset; diff < 0 || diff > time.Second {
+		t.Errorf("offset = %v, want just under %v", result.offset, ahead)
+	}
+	if result.delay < 0 || result.delay > time.Second {
+		t.Errorf("delay = %v", result.delay)
+	}
+	if got := srv.metrics.sntpRequests.Load(); got != 1 {
+		t.Errorf("SNTP requests = %d, want 1", got)
+	}
+
+	// A server that never answers (nothing reads this socket) ends in a timeout, not a hang
+	mute, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mute.Close()
+	if _, err := querySNTP(mute.LocalAddr().String(), 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("query to a mute server = %v, want a timeout", err)
+	}
+}
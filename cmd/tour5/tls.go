@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// TLS wraps the plain TCP connection: the server proves who it is with a certificate,
+// and with mutual TLS the client has to present one signed by a CA we trust as well.
+// https://pkg.go.dev/crypto/tls
+
+// newTLSConfig builds the server TLS configuration, or returns nil when TLS is disabled.
+func newTLSConfig(cfg config) (*tls.Config, error) {
+	if !cfg.tlsEnabled() {
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	if cfg.tlsSelfSigned {
+		cert, err = selfSignedCertificate(cfg.addr.host())
+		if err != nil {
+			return nil, fmt.Errorf("generating self-signed certificate: %w", err)
+		}
+		fingerprint := sha256.Sum256(cert.Certificate[0])
+		slog.Warn("Using an ephemeral self-signed certificate, clients will not trust it by default", "sha256", hex.EncodeToString(fingerprint[:]))
+	} else {
+		cert, err = tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate: %w", err)
+		}
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.tlsClientCA != "" {
+		pem, err := os.ReadFile(cfg.tlsClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %q", cfg.tlsClientCA)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// selfSignedCertificate creates a short-lived certificate for localhost (and host, if not empty),
+// kept only in memory. Good enough for local use, never for production.
+// https://go.dev/src/crypto/tls/generate_cert.go
+func selfSignedCertificate(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"golang-learning tour5"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Minute), // A little slack for clocks that are slightly behind
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	// Self-signed: the template is both the certificate and its own parent
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// handshake runs the TLS handshake of c (if it is a TLS connection) before anything is written,
+// so a failed handshake shows up as such in the logs instead of as a failed write.
+func (s *server) handshake(c *client) error {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(s.config().writeTimeout))
+	defer tlsConn.SetDeadline(time.Time{}) // Back to no deadline, handleConn sets its own
+
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	state := tlsConn.ConnectionState()
+	attrs := []any{"version", tls.VersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite)}
+	if len(state.PeerCertificates) > 0 {
+		attrs = append(attrs, "client_cn", state.PeerCertificates[0].Subject.CommonName)
+	}
+	c.log.Debug("TLS handshake done", attrs...)
+	return nil
+}
+
+func validateTLS(cfg config) error {
+	var errs []error
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		errs = append(errs, errors.New("-tls-cert and -tls-key must be used together"))
+	}
+	if cfg.tlsSelfSigned && cfg.tlsCert != "" {
+		errs = append(errs, errors.New("-tls-self-signed cannot be used with -tls-cert"))
+	}
+	if cfg.tlsClientCA != "" && !cfg.tlsEnabled() {
+		errs = append(errs, errors.New("-tls-client-ca needs TLS, set -tls-cert/-tls-key or -tls-self-signed"))
+	}
+	return errors.Join(errs...)
+}
+
+func (cfg config) tlsEnabled() bool {
+	return cfg.tlsSelfSigned || cfg.tlsCert != ""
+}
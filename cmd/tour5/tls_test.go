@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startLoopback runs the clock server with the given flags (and their -config file) on 127.0.0.1, until the test ends.
+func startLoopback(t *testing.T, args ...string) (*server, string) {
+	t.Helper()
+	base, err := loadConfig(append([]string{"-interval", "50ms"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := withConfigFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg, err := newTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newServer(base, cfg, listener, systemClock{})
+	srv.tls = tlsCfg
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go srv.ticks.run(ctx)
+	done := make(chan struct{})
+	go func() {
+		srv.serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel(context.Canceled)
+		listener.Close()
+		<-done
+		srv.drain(time.Second)
+	})
+	return srv, listener.Addr().String()
+}
+
+// waitDisconnects waits until the server recorded n connections ending for reason.
+func waitDisconnects(t *testing.T, srv *server, reason string, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.metrics.mu.Lock()
+		got := srv.metrics.disconnects[reason]
+		srv.metrics.mu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections ended with %q after 5s, want %d", got, reason, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testCA is a certificate authority that only lives for one test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // The certificate in PEM, as -tls-client-ca wants it
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// clientCertificate issues a client certificate for cn.
+func (ca *testCA) clientCertificate(t *testing.T, cn string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "tour5 test CA")
+	other := newTestCA(t, "somebody else's CA")
+	srv, addr := startLoopback(t, "-tls-self-signed", "-tls-client-ca", ca.file)
+
+	tests := []struct {
+		name   string
+		cert   *tls.Certificate
+		reject bool
+	}{
+		{name: "signed by the CA", cert: ca.clientCertificate(t, "alice")},
+		{name: "no certificate", reject: true},
+		{name: "signed by another CA", cert: other.clientCertificate(t, "mallory"), reject: true},
+	}
+	var rejected int64
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientCfg := &tls.Config{InsecureSkipVerify: true}
+			if tt.cert != nil {
+				// Sent whether or not it matches the CAs the server asks for, which is what a misconfigured client does
+				clientCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return tt.cert, nil }
+			}
+			conn, err := tls.Dial("tcp", addr, clientCfg)
+			if err == nil {
+				defer conn.Close()
+				// With TLS 1.3 the client is done before the server looked at its certificate:
+				// a refusal arrives as an alert on the first read
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err = bufio.NewReader(conn).ReadString('\n')
+			}
+			if !tt.reject {
+				if err != nil {
+					t.Fatalf("no tick with a valid client certificate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("got a tick, want the handshake to fail")
+			}
+			rejected++
+			waitDisconnects(t, srv, reasonTLSHandshake, rejected)
+		})
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config
+		want string // Part of the error, empty when the configuration is valid
+	}{
+		{name: "no TLS", cfg: config{}},
+		{name: "certificate and key", cfg: config{tlsCert: "cert.pem", tlsKey: "key.pem"}},
+		{name: "self-signed", cfg: config{tlsSelfSigned: true}},
+		{name: "mutual TLS", cfg: config{tlsSelfSigned: true, tlsClientCA: "ca.pem"}},
+		{name: "certificate without key", cfg: config{tlsCert: "cert.pem"}, want: "-tls-cert and -tls-key must be used together"},
+		{name: "key without certificate", cfg: config{tlsKey: "key.pem"}, want: "-tls-cert and -tls-key must be used together"},
+		{name: "self-signed and a certificate", cfg: config{tlsSelfSigned: true, tlsCert: "cert.pem", tlsKey: "key.pem"}, want: "-tls-self-signed cannot be used with -tls-cert"},
+		{name: "client CA without TLS", cfg: config{tlsClientCA: "ca.pem"}, want: "-tls-client-ca needs TLS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTLS(tt.cfg)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("validateTLS = %v, want no error", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("validateTLS = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
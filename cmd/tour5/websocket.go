@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal WebSocket server (RFC 6455) written on top of the standard library.
+// After the HTTP handshake, the connection is taken over ("hijacked") from net/http and wrapped in wsConn,
+// which is a net.Conn: handleConn streams ticks and reads commands exactly like it does over raw TCP,
+// while wsConn turns every write into a text frame and every text message into a line.
+// https://datatracker.ietf.org/doc/html/rfc6455
+
+// Frame opcodes
+// https://datatracker.ietf.org/doc/html/rfc6455#section-5.2
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes
+// https://datatracker.ietf.org/doc/html/rfc6455#section-7.4.1
+const (
+	closeNormal        = 1000
+	closeGoingAway     = 1001
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+)
+
+// Appended to the client key to prove the server understood the handshake
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// upgradeWebSocket answers the opening handshake and returns the connection as a wsConn.
+// On failure an HTTP error has already been written.
+// https://datatracker.ietf.org/doc/html/rfc6455#section-4.2
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !headerHasToken(r.Header, "Connection", "upgrade") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin WebSocket not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("origin %q does not match host %q", r.Header.Get("Origin"), r.Host)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("invalid Sec-WebSocket-Key")
+	}
+
+	// Taking the TCP connection over, from here on net/http no longer touches it
+	// https://pkg.go.dev/net/http#ResponseController.Hijack
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported on this connection", http.StatusInternalServerError)
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{}) // Dropping whatever timeouts net/http had set
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{Conn: conn, r: rw.Reader}, nil
+}
+
+// sameOrigin reports whether the page opening the WebSocket was served by this server. Browsers let any page
+// open a WebSocket to any host, sending the page's origin along: without this check, every site a user visits
+// could stream the clock and send commands in their name. Clients other than browsers send no Origin at all.
+// https://datatracker.ietf.org/doc/html/rfc6455#section-10.2
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// headerHasToken reports whether a comma-separated header (such as "Connection: keep-alive, Upgrade") contains token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for part := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket connection seen as a stream of lines.
+// Embedding net.Conn gives it deadlines and addresses for free, only Read, Write and Close change.
+// https://go.dev/doc/effective_go#embedding
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader // net/http may have read past the handshake already, so reading goes through its buffer
+
+	message []byte // Fragments of the message being received
+	pending []byte // Part of the last message that did not fit in the caller's buffer
+
+	// Read (pongs, close replies) and Write both send frames, from different goroutines
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closeSent bool
+}
+
+// Read returns the text of each message followed by a newline, answering pings and close frames on the way.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case opText, opBinary, opContinuation:
+			c.message = append(c.message, payload...)
+			if len(c.message) > maxCommandLength {
+				c.writeClose(closeTooBig)
+				return 0, errors.New("websocket: message too big")
+			}
+			if fin {
+				c.pending = append(c.message, '\n')
+				c.message = nil
+			}
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, err
+			}
+		case opPong:
+			// Nothing to do, the server never sends pings
+		case opClose:
+			// The closing handshake is done once we answer, and the server is the one that closes the TCP connection.
+			// The next write in handleConn then fails and the handler ends.
+			c.writeClose(closeNormal)
+			c.Conn.Close()
+			return 0, io.EOF
+		default:
+			c.writeClose(closeProtocolError)
+			return 0, fmt.Errorf("websocket: unknown opcode %#x", opcode)
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p as a single text message, without its trailing newline.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opText, bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close says goodbye with a close frame (if none was sent yet) and closes the connection.
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second)) // Best effort, the client may be gone already
+		c.writeClose(closeGoingAway)
+	})
+	return c.Conn.Close()
+}
+
+// readFrame reads one frame sent by the client.
+// https://datatracker.ietf.org/doc/html/rfc6455#section-5.2
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// Clients must mask every frame, and nothing they can send us needs to be big
+	if !masked {
+		c.writeClose(closeProtocolError)
+		return fin, opcode, nil, errors.New("websocket: client frame is not masked")
+	}
+	if length > maxCommandLength {
+		c.writeClose(closeTooBig)
+		return fin, opcode, nil, errors.New("websocket: frame too big")
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends a single unmasked frame (servers never mask) with the FIN bit set.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// writeClose sends a close frame with code, only once per connection.
+func (c *wsConn) writeClose(code uint16) {
+	c.writeMu.Lock()
+	sent := c.closeSent
+	c.closeSent = true
+	c.writeMu.Unlock()
+	if !sent {
+		c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, code))
+	}
+}
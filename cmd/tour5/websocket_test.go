@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgradeWebSocket(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgradeWebSocket(w, r); err == nil {
+			conn.Conn.Close()
+		}
+	}))
+	defer ts.Close()
+
+	// The handshake of RFC 6455 section 1.3, and what goes wrong with it
+	tests := []struct {
+		name    string
+		headers map[string]string // Replacing the ones of the RFC example, removed when empty
+		status  int
+		accept  string
+	}{
+		{name: "RFC example", status: http.StatusSwitchingProtocols, accept: "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="},
+		{name: "connection header with several tokens", headers: map[string]string{"Connection": "keep-alive, Upgrade"}, status: http.StatusSwitchingProtocols, accept: "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="},
+		{name: "no upgrade", headers: map[string]string{"Upgrade": ""}, status: http.StatusBadRequest},
+		{name: "old version", headers: map[string]string{"Sec-WebSocket-Version": "8"}, status: http.StatusUpgradeRequired},
+		{name: "key too short", headers: map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="}, status: http.StatusBadRequest},
+		{name: "page from this server", headers: map[string]string{"Origin": ts.URL}, status: http.StatusSwitchingProtocols, accept: "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="},
+		{name: "page from another site", headers: map[string]string{"Origin": "https://evil.example"}, status: http.StatusForbidden},
+		{name: "same host, other port", headers: map[string]string{"Origin": "http://127.0.0.1:1"}, status: http.StatusForbidden},
+		{name: "opaque origin", headers: map[string]string{"Origin": "null"}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{
+				"Upgrade":               "websocket",
+				"Connection":            "Upgrade",
+				"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+				"Sec-WebSocket-Version": "13",
+			}
+			for name, value := range tt.headers {
+				headers[name] = value
+			}
+			req, err := http.NewRequest("GET", ts.URL+"/ws", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range headers {
+				if value != "" {
+					req.Header.Set(name, value)
+				}
+			}
+
+			// Sent by hand: http.Client would not let go of a connection switching protocols
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := req.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != tt.accept {
+				t.Errorf("Sec-WebSocket-Accept = %q, want %q", got, tt.accept)
+			}
+		})
+	}
+}
+
+// clientFrame builds a frame the way a browser sends it: masked, unless masked is false.
+func clientFrame(fin bool, opcode byte, payload string, masked bool) []byte {
+	var frame []byte
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame = append(frame, first)
+
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	if n := len(payload); n < 126 {
+		frame = append(frame, maskBit|byte(n))
+	} else {
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d} // The one of the RFC examples, any will do
+	frame = append(frame, mask[:]...)
+	for i := range len(payload) {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// serverFrame is a frame read on the client side.
+type serverFrame struct {
+	opcode  byte
+	payload string
+}
+
+func readServerFrame(t *testing.T, r io.Reader) serverFrame {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		t.Fatalf("frame header %#x: want FIN set and no mask", head)
+	}
+	length := int(head[1] & 0x7f) // The server only sends short frames here
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("reading a frame payload: %v", err)
+	}
+	return serverFrame{opcode: head[0] & 0x0f, payload: string(payload)}
+}
+
+func closePayload(code uint16) string {
+	return string(binary.BigEndian.AppendUint16(nil, code))
+}
+
+func TestWebSocketRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  [][]byte      // Sent by the client, in order
+		replies []serverFrame // Sent back by the server while reading, in order
+		line    string        // What reading gets, empty when it fails
+		err     string        // Part of the error when it does
+	}{
+		{
+			name:   "text message",
+			frames: [][]byte{clientFrame(true, opText, "TZ Asia/Tokyo", true)},
+			line:   "TZ Asia/Tokyo\n",
+		},
+		{
+			name: "fragmented text message",
+			frames: [][]byte{
+				clientFrame(false, opText, "FORMAT ", true),
+				clientFrame(false, opContinuation, "15:04", true),
+				clientFrame(true, opContinuation, ":05", true),
+			},
+			line: "FORMAT 15:04:05\n",
+		},
+		{
+			name: "ping between fragments",
+			frames: [][]byte{
+				clientFrame(false, opText, "PA", true),
+				clientFrame(true, opPing, "are you there", true),
+				clientFrame(true, opContinuation, "USE", true),
+			},
+			replies: []serverFrame{{opcode: opPong, payload: "are you there"}},
+			line:    "PAUSE\n",
+		},
+		{
+			name:    "close",
+			frames:  [][]byte{clientFrame(true, opClose, closePayload(closeNormal), true)},
+			replies: []serverFrame{{opcode: opClose, payload: closePayload(closeNormal)}},
+			err:     "EOF",
+		},
+		{
+			name:    "unmasked frame",
+			frames:  [][]byte{clientFrame(true, opText, "QUIT", false)},
+			replies: []serverFrame{{opcode: opClose, payload: closePayload(closeProtocolError)}},
+			err:     "not masked",
+		},
+		{
+			name:    "frame over the limit",
+			frames:  [][]byte{clientFrame(true, opText, strings.Repeat("a", maxCommandLength+1), true)},
+			replies: []serverFrame{{opcode: opClose, payload: closePayload(closeTooBig)}},
+			err:     "frame too big",
+		},
+		{
+			name: "fragments over the limit",
+			frames: [][]byte{
+				clientFrame(false, opText, strings.Repeat("a", maxCommandLength), true),
+				clientFrame(true, opContinuation, "a", true),
+			},
+			replies: []serverFrame{{opcode: opClose, payload: closePayload(closeTooBig)}},
+			err:     "message too big",
+		},
+		{
+			name:    "unknown opcode",
+			frames:  [][]byte{clientFrame(true, 0x3, "", true)},
+			replies: []serverFrame{{opcode: opClose, payload: closePayload(closeProtocolError)}},
+			err:     "unknown opcode",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			ws := &wsConn{Conn: server, r: bufio.NewReader(server)}
+
+			go func() {
+				for _, frame := range tt.frames {
+					if _, err := client.Write(frame); err != nil {
+						return // The server stopped reading, as it should after an error
+					}
+				}
+			}()
+			type result struct {
+				line string
+				err  error
+			}
+			read := make(chan result, 1)
+			go func() {
+				line, err := bufio.NewReader(ws).ReadString('\n')
+				read <- result{line, err}
+			}()
+
+			for _, want := range tt.replies {
+				if got := readServerFrame(t, client); got != want {
+					t.Errorf("reply = %#x %q, want %#x %q", got.opcode, got.payload, want.opcode, want.payload)
+				}
+			}
+			got := <-read
+			if tt.err == "" {
+				if got.err != nil || got.line != tt.line {
+					t.Errorf("read %q, %v; want %q", got.line, got.err, tt.line)
+				}
+				return
+			}
+			if got.err == nil || !strings.Contains(got.err.Error(), tt.err) {
+				t.Errorf("read %q, %v; want an error containing %q", got.line, got.err, tt.err)
+			}
+		})
+	}
+}
+
+func TestWebSocketWrite(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	ws := &wsConn{Conn: server, r: bufio.NewReader(server)}
+
+	// Every line written is one text message, without its newline; closing says goodbye first
+	go func() {
+		io.WriteString(ws, "12:00:00\n")
+		ws.Close()
+	}()
+	if got, want := readServerFrame(t, client), (serverFrame{opcode: opText, payload: "12:00:00"}); got != want {
+		t.Errorf("tick frame = %#x %q, want %#x %q", got.opcode, got.payload, want.opcode, want.payload)
+	}
+	if got, want := readServerFrame(t, client), (serverFrame{opcode: opClose, payload: closePayload(closeGoingAway)}); got != want {
+		t.Errorf("closing frame = %#x %q, want %#x %q", got.opcode, got.payload, want.opcode, want.payload)
+	}
+}
+
+func TestSSEConnWrite(t *testing.T) {
+	tests := []struct {
+		name, written, event string
+	}{
+		{name: "tick", written: "12:00:00\n", event: "data: 12:00:00\n\n"},
+		{name: "reply", written: "OK TZ Asia/Tokyo\n", event: "data: OK TZ Asia/Tokyo\n\n"},
+		{name: "several lines", written: "one\ntwo\n", event: "data: one\ndata: two\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			conn, err := newSSEConn(rec, httptest.NewRequest("GET", "/stream", nil), func() {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, err := io.WriteString(conn, tt.written); err != nil || n != len(tt.written) {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+			if got := rec.Body.String(); got != tt.event {
+				t.Errorf("event = %q, want %q", got, tt.event)
+			}
+			if !rec.Flushed {
+				t.Error("event not flushed")
+			}
+		})
+	}
+}
+
+func TestServeSSE(t *testing.T) {
+	srv, _ := startLoopback(t, "-format", "rfc3339")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.serveSSE(r.Context(), w, r)
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	// Two events in a row: each tick is a "data:" line and a blank line
+	r := bufio.NewReader(resp.Body)
+	for range 2 {
+		data, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := time.Parse(time.RFC3339, strings.TrimPrefix(strings.TrimSuffix(data, "\n"), "data: ")); err != nil || !strings.HasPrefix(data, "data: ") {
+			t.Errorf("event line = %q, want \"data: \" and an RFC 3339 time", data)
+		}
+		if blank, err := r.ReadString('\n'); err != nil || blank != "\n" {
+			t.Errorf("after the data line: %q, %v; want a blank line", blank, err)
+		}
+	}
+}
+
+func TestNewSSEConnAddress(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string // Empty when the stream must be refused
+	}{
+		{remoteAddr: "192.0.2.1:1234", want: "192.0.2.1:1234"},
+		{remoteAddr: "[2001:db8::1]:80", want: "[2001:db8::1]:80"},
+		{remoteAddr: "@"}, // What net/http reports for a Unix socket client
+		{remoteAddr: ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/stream", nil)
+		req.RemoteAddr = tt.remoteAddr
+		conn, err := newSSEConn(httptest.NewRecorder(), req, func() {})
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("RemoteAddr %q: got a stream from %v, want it refused", tt.remoteAddr, conn.RemoteAddr())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("RemoteAddr %q: %v", tt.remoteAddr, err)
+			continue
+		}
+		if got := conn.RemoteAddr().String(); got != tt.want {
+			t.Errorf("RemoteAddr %q: got %s, want %s", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+// TestDrainClosesSSE checks that a forced drain ends an event stream stuck writing to a client that stopped reading.
+func TestDrainClosesSSE(t *testing.T) {
+	// Long lines every millisecond fill the socket buffers quickly; only the drain may end the stuck write
+	layout := strings.Repeat("15:04:05.000 ", 300)
+	srv, _ := startLoopback(t, "-interval", "1ms", "-format", layout, "-write-timeout", "1h", "-max-lag", "0")
+	// The server context is never cancelled, so the handler cannot stop by itself
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.serveSSE(context.Background(), w, r)
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// Not reading from here on; once the writes stop adding up, the handler is blocked in one
+	for written := int64(-1); written != srv.metrics.bytesWritten.Load(); {
+		written = srv.metrics.bytesWritten.Load()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	start := time.Now()
+	drained, forced := srv.drain(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("drain took %v, the stuck write was not interrupted", elapsed)
+	}
+	if drained != 0 || forced != 1 {
+		t.Errorf("drained %d and forced %d connections, want 0 and 1", drained, forced)
+	}
+	srv.metrics.mu.Lock()
+	evicted := srv.metrics.disconnects[reasonWriteTimeout]
+	srv.metrics.mu.Unlock()
+	if evicted != 1 {
+		t.Errorf("%d streams ended by a write timeout, want the stuck one", evicted)
+	}
+}
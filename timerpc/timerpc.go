@@ -0,0 +1,121 @@
+// Package timerpc is the Go client of the tour5 time service, a JSON-RPC alternative to the text stream
+// for programs that would rather not parse "15:04:05" lines (see -rpc-addr in cmd/tour5):
+//
+//	c, err := timerpc.Dial("localhost:8004")
+//	...
+//	now, err := c.Now(ctx, "Asia/Tokyo", "kitchen")
+//	fmt.Println(now.Formatted, now.Time)
+//
+// The service speaks net/rpc with the JSON codec (JSON-RPC 1.0), one JSON object per call over a plain
+// TCP connection, so other languages can call it too:
+//
+//	{"method": "Time.Now", "params": [{"Zone": "Asia/Tokyo"}], "id": 1}
+//
+// https://pkg.go.dev/net/rpc/jsonrpc
+package timerpc
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+)
+
+// ServiceName is the name the service is registered under, methods are called as "Time.Now" and so on.
+const ServiceName = "Time"
+
+// NowArgs are the arguments of Time.Now.
+type NowArgs struct {
+	Zone   string // IANA time zone such as "America/Sao_Paulo", empty for the server default
+	Layout string // A -format preset or a Go layout for Formatted, empty for the server default
+}
+
+// ConvertArgs are the arguments of Time.Convert.
+type ConvertArgs struct {
+	// RFC 3339 ("2026-10-18T15:30:00Z", which carries its own offset and ignores From),
+	// a date and time ("2026-10-18 15:30[:05]") or a time of day ("15:30[:05]", today in From)
+	Time string
+	From string // Time zone Time is in, empty for the server default
+	To   string // Time zone to convert to, empty for the server default
+}
+
+// UntilArgs are the arguments of Time.Until.
+type UntilArgs struct {
+	// Same forms as ConvertArgs.Time, except that a time of day means its next occurrence,
+	// like the ALARM command of the text protocol
+	Target string
+	Zone   string // Time zone Target is in, empty for the server default
+}
+
+// TimeReply is the answer of Time.Now and Time.Convert.
+type TimeReply struct {
+	Time      time.Time // In Zone. JSON keeps the offset but not the zone name, hence the next field.
+	Zone      string
+	Formatted string
+}
+
+// UntilReply is the answer of Time.Until.
+type UntilReply struct {
+	Target   time.Time
+	Duration time.Duration // Negative when Target is in the past. Nanoseconds, in JSON.
+}
+
+// Client calls the time service over one connection. Like the rpc.Client it wraps, it is safe for
+// concurrent use: calls made at the same time share the connection.
+type Client struct {
+	rpc *rpc.Client
+}
+
+// Dial connects to the time service at addr (host:port) over plain TCP.
+func Dial(addr string) (*Client, error) {
+	c, err := jsonrpc.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{rpc: c}, nil
+}
+
+// NewClient uses an already open connection, e.g. a *tls.Conn when the server runs with TLS.
+func NewClient(conn io.ReadWriteCloser) *Client {
+	return &Client{rpc: jsonrpc.NewClient(conn)}
+}
+
+// Close closes the connection, calls still waiting get rpc.ErrShutdown.
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// Now is the current time on the server, in zone and formatted with layout (both may be empty, see NowArgs).
+func (c *Client) Now(ctx context.Context, zone, layout string) (TimeReply, error) {
+	return call[TimeReply](ctx, c, "Now", NowArgs{Zone: zone, Layout: layout})
+}
+
+// Convert shows t, a time in the from time zone, in the to time zone (see ConvertArgs for what t may look like).
+func (c *Client) Convert(ctx context.Context, t, from, to string) (TimeReply, error) {
+	return call[TimeReply](ctx, c, "Convert", ConvertArgs{Time: t, From: from, To: to})
+}
+
+// Until is how long from now, on the server clock, until target (see UntilArgs).
+func (c *Client) Until(ctx context.Context, target, zone string) (UntilReply, error) {
+	return call[UntilReply](ctx, c, "Until", UntilArgs{Target: target, Zone: zone})
+}
+
+// call makes the call asynchronously, so it can stop waiting when ctx ends: net/rpc itself knows nothing about contexts.
+// The reply of an abandoned call may still arrive later, it is written into a value nobody reads anymore.
+// https://pkg.go.dev/net/rpc#Client.Go
+func call[R any](ctx context.Context, c *Client, method string, args any) (R, error) {
+	reply := new(R)
+	pending := c.rpc.Go(ServiceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-pending.Done:
+		if pending.Error != nil {
+			var zero R
+			return zero, pending.Error
+		}
+		return *reply, nil
+	case <-ctx.Done():
+		var zero R
+		return zero, context.Cause(ctx)
+	}
+}